@@ -0,0 +1,29 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/creighbattle/chirpy/auth"
+)
+
+// authorizeAdmin checks for "Authorization: ApiKey <ADMIN_KEY>" and writes
+// the error response itself when the request is not allowed.
+func (cfg *apiConfig) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if cfg.adminKey == "" {
+		respondWithError(w, http.StatusForbidden, "admin endpoints are disabled; set ADMIN_KEY to enable them")
+		return false
+	}
+
+	apiKey, err := auth.GetAPIKey(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(apiKey), []byte(cfg.adminKey)) != 1 {
+		respondWithError(w, http.StatusUnauthorized, "invalid api key")
+		return false
+	}
+	return true
+}
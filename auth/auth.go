@@ -0,0 +1,286 @@
+// Package auth issues and checks the access tokens chirpy hands out at login.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const Issuer = "chirpy"
+
+// MFAAudience marks the short-lived token handed out after a correct
+// password when the user still has to enter their second factor. Access
+// tokens have no audience, so the two can never be mistaken for each other.
+const MFAAudience = "chirpy-mfa"
+
+// OIDCStateAudience marks the token that carries an OpenID Connect login from
+// its start to the provider's callback.
+const OIDCStateAudience = "chirpy-oidc-state"
+
+var ErrNoToken = errors.New("access token required")
+
+var ErrInvalidToken = errors.New("invalid token")
+
+var ErrNoAPIKey = errors.New("api key required")
+
+var ErrRevokedToken = errors.New("token has been revoked")
+
+var ErrInvalidAPIKey = errors.New("invalid api key")
+
+// AccessToken is what a valid access token says about its bearer. ID is the
+// token's jti, which is what revoking it refers to.
+type AccessToken struct {
+	UserID    int
+	ID        string
+	ExpiresAt time.Time
+	Scopes    []string
+}
+
+// scopedClaims carry scopes space-separated in "scope", as in RFC 9068.
+// Tokens without any are rejected rather than read as allowed to do
+// anything.
+type scopedClaims struct {
+	jwt.RegisteredClaims
+	Scope string `json:"scope,omitempty"`
+}
+
+// Denylist reports access tokens that were revoked before they expired.
+type Denylist interface {
+	IsAccessTokenRevoked(tokenID string) (bool, error)
+}
+
+// APIKeyVerifier checks a personal API key and returns whose it is and what
+// it may be used for. Unknown and expired keys are ErrInvalidAPIKey.
+type APIKeyVerifier func(key string) (userID int, scopes []string, err error)
+
+func MakeJWT(userID int, scopes []string, keys *KeySet, expiresIn time.Duration) (string, AccessToken, error) {
+	// A token without scopes would be rejected.
+	if len(scopes) == 0 {
+		return "", AccessToken{}, errors.New("access token needs at least one scope")
+	}
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", AccessToken{}, err
+	}
+
+	now := time.Now().UTC()
+	accessToken := AccessToken{
+		UserID:    userID,
+		ID:        hex.EncodeToString(id),
+		ExpiresAt: now.Add(expiresIn),
+		Scopes:    scopes,
+	}
+	signed, err := keys.Sign(scopedClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    Issuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(accessToken.ExpiresAt),
+			Subject:   strconv.Itoa(userID),
+			ID:        accessToken.ID,
+		},
+		Scope: strings.Join(scopes, " "),
+	})
+	if err != nil {
+		return "", AccessToken{}, err
+	}
+	return signed, accessToken, nil
+}
+
+// ValidateJWT checks an access token's signature and claims. Only tokens from
+// our own issuer, signed with an algorithm and key keys knows about, are
+// accepted, so a token signed with "none" or minted by someone else is turned
+// away. Whether it was revoked is up to the caller.
+func ValidateJWT(tokenString string, keys *KeySet) (AccessToken, error) {
+	claims := &scopedClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, keys.keyfunc,
+		jwt.WithIssuer(Issuer), jwt.WithValidMethods(keys.validMethods()), jwt.WithExpirationRequired())
+	if err != nil {
+		return AccessToken{}, ErrInvalidToken
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	scopes := strings.Fields(claims.Scope)
+	if err != nil || claims.ID == "" || len(claims.Audience) > 0 || len(scopes) == 0 {
+		return AccessToken{}, ErrInvalidToken
+	}
+	return AccessToken{UserID: userID, ID: claims.ID, ExpiresAt: claims.ExpiresAt.Time, Scopes: scopes}, nil
+}
+
+// MakeMFAChallenge returns a token proving the user got their password right,
+// to be exchanged for an access token with the scopes they asked for together
+// with their second factor.
+func MakeMFAChallenge(userID int, scopes []string, keys *KeySet, expiresIn time.Duration) (string, error) {
+	now := time.Now().UTC()
+	return keys.SignInternal(scopedClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    Issuer,
+			Audience:  jwt.ClaimStrings{MFAAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(expiresIn)),
+			Subject:   strconv.Itoa(userID),
+		},
+		Scope: strings.Join(scopes, " "),
+	})
+}
+
+func ValidateMFAChallenge(tokenString string, keys *KeySet) (int, []string, error) {
+	claims := &scopedClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, keys.internalKeyfunc,
+		jwt.WithIssuer(Issuer), jwt.WithAudience(MFAAudience), jwt.WithExpirationRequired())
+	if err != nil {
+		return 0, nil, ErrInvalidToken
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	scopes := strings.Fields(claims.Scope)
+	if err != nil || len(scopes) == 0 {
+		return 0, nil, ErrInvalidToken
+	}
+	return userID, scopes, nil
+}
+
+// OIDCState is what the callback of an OpenID Connect login needs from its
+// start. It travels in a cookie as a signed token, so the server keeps no
+// state for logins that are never finished.
+type OIDCState struct {
+	Provider     string `json:"provider"`
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+}
+
+type oidcStateClaims struct {
+	OIDCState
+	jwt.RegisteredClaims
+}
+
+func MakeOIDCState(state OIDCState, keys *KeySet, expiresIn time.Duration) (string, error) {
+	now := time.Now().UTC()
+	return keys.SignInternal(oidcStateClaims{
+		OIDCState: state,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    Issuer,
+			Audience:  jwt.ClaimStrings{OIDCStateAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(expiresIn)),
+		},
+	})
+}
+
+func ValidateOIDCState(tokenString string, keys *KeySet) (OIDCState, error) {
+	claims := &oidcStateClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, keys.internalKeyfunc,
+		jwt.WithIssuer(Issuer), jwt.WithAudience(OIDCStateAudience), jwt.WithExpirationRequired())
+	if err != nil {
+		return OIDCState{}, ErrInvalidToken
+	}
+	return claims.OIDCState, nil
+}
+
+// GetBearerToken returns the token from an "Authorization: Bearer TOKEN"
+// header.
+func GetBearerToken(header http.Header) (string, error) {
+	token, ok := strings.CutPrefix(header.Get("Authorization"), "Bearer ")
+	token = strings.TrimSpace(token)
+	if !ok || token == "" {
+		return "", ErrNoToken
+	}
+	return token, nil
+}
+
+// GetAPIKey returns the key from an "Authorization: ApiKey KEY" header.
+func GetAPIKey(header http.Header) (string, error) {
+	key, ok := strings.CutPrefix(header.Get("Authorization"), "ApiKey ")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return "", ErrNoAPIKey
+	}
+	return key, nil
+}
+
+type contextKey int
+
+const (
+	userIDKey contextKey = iota
+	scopesKey
+)
+
+// RequireUser rejects requests without a valid, unrevoked access token, or,
+// unless apiKeys is nil, a valid API key, with 401. It makes the user ID
+// available to next through UserIDFromContext, and what the credential may do
+// through ScopesFromContext.
+func RequireUser(keys *KeySet, denylist Denylist, apiKeys APIKeyVerifier) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key, err := GetAPIKey(r.Header); err == nil && apiKeys != nil {
+				userID, scopes, err := apiKeys(key)
+				if errors.Is(err, ErrInvalidAPIKey) {
+					writeError(w, http.StatusUnauthorized, err)
+					return
+				}
+				if err != nil {
+					writeError(w, http.StatusInternalServerError, errors.New("couldn't check api key"))
+					return
+				}
+				ctx := WithScopes(WithUserID(r.Context(), userID), scopes)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			token, err := GetBearerToken(r.Header)
+			if err != nil {
+				writeError(w, http.StatusUnauthorized, err)
+				return
+			}
+			accessToken, err := ValidateJWT(token, keys)
+			if err != nil {
+				writeError(w, http.StatusUnauthorized, err)
+				return
+			}
+			revoked, err := denylist.IsAccessTokenRevoked(accessToken.ID)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, errors.New("couldn't check token"))
+				return
+			}
+			if revoked {
+				writeError(w, http.StatusUnauthorized, ErrRevokedToken)
+				return
+			}
+
+			ctx := WithScopes(WithUserID(r.Context(), accessToken.UserID), accessToken.Scopes)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func WithUserID(ctx context.Context, userID int) context.Context {
+	return context.WithValue(ctx, userIDKey, userID)
+}
+
+// UserIDFromContext returns the user RequireUser authenticated. ok is false
+// if the handler was not wrapped in RequireUser.
+func UserIDFromContext(ctx context.Context) (userID int, ok bool) {
+	userID, ok = ctx.Value(userIDKey).(int)
+	return userID, ok
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	dat, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{
+		Error: err.Error(),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(dat)
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestValidateJWTScopes(t *testing.T) {
+	keys := testHMACKeySet(t, "secret")
+
+	token, _, err := MakeJWT(1, []string{ScopeChirpsWrite}, keys, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessToken, err := ValidateJWT(token, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(accessToken.Scopes, []string{ScopeChirpsWrite}) {
+		t.Fatalf("got scopes %v, want [%s]", accessToken.Scopes, ScopeChirpsWrite)
+	}
+
+	_, _, err = MakeJWT(1, nil, keys, time.Minute)
+	if err == nil {
+		t.Fatal("MakeJWT without scopes: got no error")
+	}
+
+	now := time.Now()
+	unscoped, err := keys.Sign(scopedClaims{RegisteredClaims: jwt.RegisteredClaims{
+		Issuer:    Issuer,
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		Subject:   strconv.Itoa(1),
+		ID:        "jti",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ValidateJWT(unscoped, keys)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("token without scope: got %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestValidateMFAChallengeScopes(t *testing.T) {
+	keys := testHMACKeySet(t, "secret")
+
+	challenge, err := MakeMFAChallenge(1, nil, keys, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = ValidateMFAChallenge(challenge, keys)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("challenge without scope: got %v, want ErrInvalidToken", err)
+	}
+}
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// PasswordHasher hashes new passwords one way but verifies every supported
+// kind of hash, since the algorithm and its parameters are encoded in the
+// hash itself. That lets them be changed without anyone resetting their
+// password: Verify reports when a hash is weaker than what Hash would make
+// now, and the caller stores a new hash while it has the password at hand.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password string, hash string) (match bool, needsRehash bool, err error)
+}
+
+// Argon2idHasher hashes with argon2id (RFC 9106), encoded in the PHC string
+// format "$argon2id$v=19$m=<KiB>,t=<iterations>,p=<threads>$<salt>$<key>".
+type Argon2idHasher struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// DefaultArgon2idHasher uses OWASP's recommended minimum parameters.
+func DefaultArgon2idHasher() Argon2idHasher {
+	return Argon2idHasher{Memory: 19 * 1024, Iterations: 2, Parallelism: 1}
+}
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h Argon2idHasher) Verify(password string, hash string) (bool, bool, error) {
+	match, params, err := verifyPassword(password, hash)
+	if err != nil {
+		return false, false, err
+	}
+	current, ok := params.(Argon2idHasher)
+	needsRehash := !ok || current.Memory < h.Memory || current.Iterations < h.Iterations || current.Parallelism < h.Parallelism
+	return match, needsRehash, nil
+}
+
+// BcryptHasher hashes with bcrypt, which already encodes its cost in the
+// hash. Passwords longer than 72 bytes can't be hashed.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(hash), err
+}
+
+func (h BcryptHasher) Verify(password string, hash string) (bool, bool, error) {
+	match, params, err := verifyPassword(password, hash)
+	if err != nil {
+		return false, false, err
+	}
+	current, ok := params.(BcryptHasher)
+	return match, !ok || current.Cost < h.Cost, nil
+}
+
+// verifyPassword checks password against a hash of any supported kind, and
+// returns a hasher with the parameters the hash was made with.
+func verifyPassword(password string, hash string) (bool, PasswordHasher, error) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return verifyArgon2id(password, hash)
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return false, nil, ErrUnknownHash
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, BcryptHasher{Cost: cost}, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	return true, BcryptHasher{Cost: cost}, nil
+}
+
+func verifyArgon2id(password string, hash string) (bool, PasswordHasher, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, nil, ErrUnknownHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return false, nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	params := Argon2idHasher{}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return false, nil, fmt.Errorf("bad argon2 parameters %q: %w", parts[3], err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, nil, fmt.Errorf("bad argon2 salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, nil, fmt.Errorf("bad argon2 key: %w", err)
+	}
+
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, params, nil
+}
@@ -0,0 +1,250 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Key is one signing or verification key. Its ID goes in the kid header of
+// the tokens it signs.
+type Key struct {
+	ID      string
+	Method  jwt.SigningMethod
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+// KeySet holds the key new tokens are signed with and every key tokens are
+// still accepted from.
+//
+// Keys are loaded from a directory of PEM files named <kid>.pem, each either
+// an RSA or Ed25519 private key, or just the public half of a retired key.
+// The private key whose kid sorts last signs new tokens, so to rotate, add a
+// key with a later name (a date works well) and remove the old one, or swap
+// it for its public key, once the tokens it signed have expired.
+//
+// A KeySet made with NewHMACKeySet signs with the shared JWT_SECRET instead.
+// A secret can also be kept alongside a key directory so HS256 tokens issued
+// before the switch stay valid until they expire.
+//
+// Tokens chirpy only hands to itself, such as MFA challenges, are signed with
+// SignInternal instead, using a key derived from the signing key or secret.
+// That key is never published, so a service trusting the JWKS can't take
+// them for access tokens.
+type KeySet struct {
+	signing  *Key
+	keys     map[string]*Key
+	secret   []byte
+	internal []byte
+}
+
+// NewHMACKeySet refuses an empty secret, which would make every token, and
+// the internal key derived from it, forgeable.
+func NewHMACKeySet(secret []byte) (*KeySet, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("JWT secret must not be empty")
+	}
+	return &KeySet{keys: map[string]*Key{}, secret: secret, internal: deriveInternalKey(secret)}, nil
+}
+
+// deriveInternalKey makes the internal key from secret material, so every
+// instance sharing a key directory or JWT_SECRET derives the same one.
+func deriveInternalKey(material []byte) []byte {
+	mac := hmac.New(sha256.New, material)
+	mac.Write([]byte("chirpy internal tokens"))
+	return mac.Sum(nil)
+}
+
+// LoadKeyDir reads every *.pem file in dir. secret may be nil; see KeySet.
+func LoadKeyDir(dir string, secret []byte) (*KeySet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	ks := &KeySet{keys: map[string]*Key{}, secret: secret}
+	for _, path := range paths {
+		key, err := readKeyFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %w", path, err)
+		}
+		ks.keys[key.ID] = key
+		if key.private != nil {
+			ks.signing = key
+		}
+	}
+	if ks.signing == nil {
+		return nil, fmt.Errorf("no private key in %s", dir)
+	}
+	material, err := x509.MarshalPKCS8PrivateKey(ks.signing.private)
+	if err != nil {
+		return nil, err
+	}
+	// Rotating the signing key also rotates the internal key, which only
+	// cuts short the few minutes internal tokens live.
+	ks.internal = deriveInternalKey(material)
+	return ks, nil
+}
+
+func readKeyFile(path string) (*Key, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(dat)
+	if block == nil {
+		return nil, errors.New("not a PEM file")
+	}
+
+	key := &Key{ID: strings.TrimSuffix(filepath.Base(path), ".pem")}
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if signer, ok := parsed.(crypto.Signer); ok {
+		key.private = signer
+		parsed = signer.Public()
+	}
+	switch pub := parsed.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		key.Method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+	key.public = parsed
+	return key, nil
+}
+
+// Sign signs claims with the current key, or the shared secret if there are
+// no keys.
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	if ks.signing == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(ks.secret)
+	}
+
+	token := jwt.NewWithClaims(ks.signing.Method, claims)
+	token.Header["kid"] = ks.signing.ID
+	return token.SignedString(ks.signing.private)
+}
+
+// SignInternal signs claims with the internal key; see KeySet.
+func (ks *KeySet) SignInternal(claims jwt.Claims) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(ks.internal)
+}
+
+func (ks *KeySet) internalKeyfunc(token *jwt.Token) (interface{}, error) {
+	if token.Method != jwt.SigningMethodHS256 {
+		return nil, errors.New("internal tokens are HS256")
+	}
+	return ks.internal, nil
+}
+
+// keyfunc picks the verification key by kid and only accepts it for the
+// algorithm it was loaded for, so an RSA public key can never be used as an
+// HMAC secret.
+func (ks *KeySet) keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		if ks.secret == nil || token.Method != jwt.SigningMethodHS256 {
+			return nil, errors.New("token has no kid")
+		}
+		return ks.secret, nil
+	}
+
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if token.Method != key.Method {
+		return nil, fmt.Errorf("kid %q is not a %s key", kid, token.Method.Alg())
+	}
+	return key.public, nil
+}
+
+func (ks *KeySet) validMethods() []string {
+	methods := []string{}
+	if ks.secret != nil {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	for _, method := range []jwt.SigningMethod{jwt.SigningMethodRS256, jwt.SigningMethodEdDSA} {
+		for _, key := range ks.keys {
+			if key.Method == method {
+				methods = append(methods, method.Alg())
+				break
+			}
+		}
+	}
+	return methods
+}
+
+// JWK is a public key in the JSON Web Key format (RFC 7517).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS lists the public keys tokens can be verified with. The shared secret,
+// if any, is of course left out.
+func (ks *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range ks.keys {
+		jwk := JWK{KeyID: key.ID, Use: "sig", Algorithm: key.Method.Alg()}
+		switch pub := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	sort.Slice(jwks.Keys, func(i, j int) bool {
+		return jwks.Keys[i].KeyID < jwks.Keys[j].KeyID
+	})
+	return jwks
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func testKeyDir(t *testing.T) *KeySet {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	err = os.WriteFile(filepath.Join(dir, "2026-01-01.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadKeyDir(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func testHMACKeySet(t *testing.T, secret string) *KeySet {
+	t.Helper()
+	keys, err := NewHMACKeySet([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestEmptySecretRefused(t *testing.T) {
+	for _, secret := range [][]byte{nil, {}} {
+		_, err := NewHMACKeySet(secret)
+		if err == nil {
+			t.Errorf("NewHMACKeySet(%q): got no error", secret)
+		}
+	}
+}
+
+func TestInternalTokensAreNotAccessTokens(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		keys *KeySet
+	}{
+		{"secret", testHMACKeySet(t, "secret")},
+		{"key dir", testKeyDir(t)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			challenge, err := MakeMFAChallenge(1, AllScopes, tc.keys, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			userID, _, err := ValidateMFAChallenge(challenge, tc.keys)
+			if err != nil || userID != 1 {
+				t.Fatalf("ValidateMFAChallenge = %d, %v", userID, err)
+			}
+			_, err = ValidateJWT(challenge, tc.keys)
+			if err == nil {
+				t.Error("MFA challenge accepted as an access token")
+			}
+
+			state, err := MakeOIDCState(OIDCState{Provider: "test"}, tc.keys, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = ValidateOIDCState(state, tc.keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// A service that only trusts the published keys must turn both
+			// away.
+			for _, token := range []string{challenge, state} {
+				_, err = jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+					for _, jwk := range tc.keys.JWKS().Keys {
+						x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+						if err != nil {
+							return nil, err
+						}
+						return ed25519.PublicKey(x), nil
+					}
+					return nil, jwt.ErrTokenUnverifiable
+				})
+				if err == nil {
+					t.Error("internal token verified with a published key")
+				}
+			}
+		})
+	}
+}
+
+func TestInternalKeyIsSharedBetweenInstances(t *testing.T) {
+	challenge, err := MakeMFAChallenge(1, AllScopes, testHMACKeySet(t, "secret"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = ValidateMFAChallenge(challenge, testHMACKeySet(t, "secret"))
+	if err != nil {
+		t.Errorf("challenge from another instance rejected: %v", err)
+	}
+	_, _, err = ValidateMFAChallenge(challenge, testHMACKeySet(t, "other secret"))
+	if err == nil {
+		t.Error("challenge accepted with a different secret")
+	}
+}
@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxPasswordBytes is the most bcrypt will hash. It applies whichever
+// PasswordHasher is in use, so that passwords never stop working if bcrypt
+// is chosen again.
+const MaxPasswordBytes = 72
+
+// PasswordPolicy decides which passwords users may choose.
+type PasswordPolicy struct {
+	MinLength int
+	// MinScore is the lowest acceptable EstimateStrength score, 0 to 4.
+	MinScore int
+	// Breaches, if set, rejects passwords known from data breaches.
+	Breaches BreachChecker
+}
+
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{MinLength: 8, MinScore: 3}
+}
+
+// PasswordViolation is one reason a password was rejected. Code is stable for
+// clients to switch on; Message is for people.
+type PasswordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Check returns every way password breaks the policy, or nothing if it is
+// acceptable. userInputs are things like the user's email address that
+// shouldn't be part of their password. An error means the breach list
+// couldn't be read.
+func (p PasswordPolicy) Check(password string, userInputs ...string) ([]PasswordViolation, error) {
+	violations := []PasswordViolation{}
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, PasswordViolation{
+			Code:    "too_short",
+			Message: fmt.Sprintf("Password must be at least %d characters", p.MinLength),
+		})
+	}
+	if len(password) > MaxPasswordBytes {
+		violations = append(violations, PasswordViolation{
+			Code:    "too_long",
+			Message: fmt.Sprintf("Password must be at most %d bytes", MaxPasswordBytes),
+		})
+	}
+	if len(violations) > 0 {
+		return violations, nil
+	}
+
+	strength := EstimateStrength(password, userInputs...)
+	if strength.Score < p.MinScore {
+		msg := "Password is too easy to guess"
+		if strength.Warning != "" {
+			msg += ": " + strength.Warning
+		}
+		violations = append(violations, PasswordViolation{Code: "too_weak", Message: msg})
+	}
+
+	if p.Breaches != nil {
+		breached, err := IsBreached(p.Breaches, password)
+		if err != nil {
+			return nil, err
+		}
+		if breached {
+			violations = append(violations, PasswordViolation{
+				Code:    "breached",
+				Message: "Password has appeared in a data breach, so attackers will try it",
+			})
+		}
+	}
+	return violations, nil
+}
+
+// BreachChecker looks up breached passwords without ever seeing one, using
+// the k-anonymity scheme of Have I Been Pwned: given the first 5 hex digits of
+// a password's SHA-1 hash, Range returns the other 35 digits of every
+// breached hash with that prefix, with how often each was seen.
+type BreachChecker interface {
+	Range(prefix string) (map[string]int, error)
+}
+
+// IsBreached hashes password and checks the breach list for it.
+func IsBreached(checker BreachChecker, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	suffixes, err := checker.Range(hash[:5])
+	if err != nil {
+		return false, err
+	}
+	_, ok := suffixes[hash[5:]]
+	return ok, nil
+}
+
+// BreachFile is a BreachChecker for a local copy of the Pwned Passwords list:
+// a text file of "<SHA-1 hex>:<count>" lines sorted by hash, as written by the
+// PwnedPasswordsDownloader in single-file mode. It is searched in place, so
+// even the full list needs no memory.
+type BreachFile struct {
+	f    *os.File
+	size int64
+}
+
+func OpenBreachFile(path string) (*BreachFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &BreachFile{f: f, size: info.Size()}, nil
+}
+
+func (b *BreachFile) Close() error {
+	return b.f.Close()
+}
+
+func (b *BreachFile) Range(prefix string) (map[string]int, error) {
+	prefix = strings.ToUpper(prefix)
+	if len(prefix) != 5 {
+		return nil, errors.New("hash prefix must be 5 hex digits")
+	}
+
+	// Binary search for the first line whose hash is not before prefix. Any
+	// offset stands for the first line starting at or after it.
+	lo, hi := int64(0), b.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, err := b.lineStart(mid)
+		if err != nil {
+			return nil, err
+		}
+		line, err := b.lineAt(start)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" || strings.ToUpper(line) >= prefix {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	start, err := b.lineStart(lo)
+	if err != nil {
+		return nil, err
+	}
+	suffixes := map[string]int{}
+	scanner := bufio.NewScanner(io.NewSectionReader(b.f, start, b.size-start))
+	for scanner.Scan() {
+		line := strings.ToUpper(strings.TrimSpace(scanner.Text()))
+		if !strings.HasPrefix(line, prefix) {
+			break
+		}
+		hash, count, _ := strings.Cut(line, ":")
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			n = 1
+		}
+		suffixes[hash[5:]] = n
+	}
+	return suffixes, scanner.Err()
+}
+
+// lineStart returns the offset of the first line starting at or after off.
+func (b *BreachFile) lineStart(off int64) (int64, error) {
+	if off == 0 {
+		return 0, nil
+	}
+	r := bufio.NewReader(io.NewSectionReader(b.f, off-1, b.size-off+1))
+	skipped, err := r.ReadString('\n')
+	if err == io.EOF {
+		return b.size, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return off - 1 + int64(len(skipped)), nil
+}
+
+func (b *BreachFile) lineAt(off int64) (string, error) {
+	r := bufio.NewReader(io.NewSectionReader(b.f, off, b.size-off))
+	line, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
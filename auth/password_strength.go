@@ -0,0 +1,290 @@
+package auth
+
+import (
+	_ "embed"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// PasswordStrength is a rough estimate of how many guesses an attacker who
+// knows common password patterns would need, in the style of zxcvbn.
+type PasswordStrength struct {
+	// Guesses is log10 of the estimated number of guesses.
+	Guesses float64
+	// Score runs from 0 (trivial to guess) to 4 (infeasible to guess).
+	Score int
+	// Warning explains the weakest part of the password, if any.
+	Warning string
+}
+
+//go:embed common_passwords.txt
+var commonPasswordList string
+
+// commonPasswords maps each common password to its rank, most common first.
+var commonPasswords = func() map[string]int {
+	ranks := map[string]int{}
+	for i, word := range strings.Fields(commonPasswordList) {
+		ranks[word] = i + 1
+	}
+	return ranks
+}()
+
+var keyboardRows = []string{
+	"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./",
+	"1qaz", "2wsx", "3edc", "4rfv", "5tgb", "6yhn", "7ujm", "8ik,", "9ol.", "0p;/",
+}
+
+var leetSubstitutions = strings.NewReplacer(
+	"4", "a", "@", "a", "8", "b", "(", "c", "3", "e", "6", "g", "1", "i", "!", "i",
+	"0", "o", "$", "s", "5", "s", "7", "t", "+", "t", "2", "z",
+)
+
+// patternMatch is a run of the password that follows a guessable pattern.
+type patternMatch struct {
+	start, end int
+	guesses    float64
+	warning    string
+}
+
+// EstimateStrength finds the cheapest way to build password out of guessable
+// patterns (common passwords, the user's own details, repeats, sequences,
+// keyboard walks and years) and single brute-forced characters, and scores
+// the number of guesses that takes. userInputs, such as the email address,
+// count as the most common passwords of all.
+func EstimateStrength(password string, userInputs ...string) PasswordStrength {
+	runes := []rune(password)
+	n := len(runes)
+	if n == 0 {
+		return PasswordStrength{Warning: "Password is empty"}
+	}
+
+	personal := map[string]bool{}
+	for _, input := range userInputs {
+		for _, word := range userInputWords(input) {
+			personal[word] = true
+		}
+	}
+
+	matches := findMatches(runes, personal)
+
+	// best[i] is the fewest log10 guesses for the first i runes, and via[i]
+	// the match that ends the cheapest way there, if any.
+	best := make([]float64, n+1)
+	via := make([]*patternMatch, n+1)
+	for i := 1; i <= n; i++ {
+		best[i] = best[i-1] + math.Log10(bruteForceCardinality(runes[i-1]))
+		for j := range matches {
+			m := &matches[j]
+			if m.end != i {
+				continue
+			}
+			if g := best[m.start] + math.Log10(m.guesses); g < best[i] {
+				best[i] = g
+				via[i] = m
+			}
+		}
+	}
+
+	strength := PasswordStrength{Guesses: best[n], Score: score(best[n])}
+
+	// Warn about the pattern that covers the most of the password.
+	var worst *patternMatch
+	for i := n; i > 0; {
+		m := via[i]
+		if m == nil {
+			i--
+			continue
+		}
+		if worst == nil || m.end-m.start > worst.end-worst.start {
+			worst = m
+		}
+		i = m.start
+	}
+	if worst != nil {
+		strength.Warning = worst.warning
+	}
+	return strength
+}
+
+// score uses zxcvbn's thresholds: 4 is beyond even an offline attack on a
+// fast hash, 3 beyond one on a slow hash like bcrypt, 2 beyond an online
+// attack without throttling.
+func score(log10Guesses float64) int {
+	switch {
+	case log10Guesses < 3:
+		return 0
+	case log10Guesses < 6:
+		return 1
+	case log10Guesses < 8:
+		return 2
+	case log10Guesses < 10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+func bruteForceCardinality(r rune) float64 {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		return 26
+	case r >= '0' && r <= '9':
+		return 10
+	case r < unicode.MaxASCII:
+		return 33
+	default:
+		return 100
+	}
+}
+
+// userInputWords splits an input like "jo.smith@example.com" into the parts
+// someone might build a password from.
+func userInputWords(input string) []string {
+	input = strings.ToLower(input)
+	words := []string{input}
+	for _, word := range strings.FieldsFunc(input, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(word) >= 3 {
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// dictionaryRank looks word up, also with common character substitutions
+// undone, which doubles its rank.
+func dictionaryRank(word string, personal map[string]bool) (rank float64, warning string, ok bool) {
+	for i, w := range []string{word, leetSubstitutions.Replace(word)} {
+		multiplier := float64(i + 1)
+		if personal[w] {
+			return multiplier, "Don't use your email address or other personal details", true
+		}
+		if r, found := commonPasswords[w]; found {
+			warning = "This is a common password"
+			if r <= 100 {
+				warning = "This is one of the most common passwords"
+			}
+			return float64(r) * multiplier, warning, true
+		}
+	}
+	return 0, "", false
+}
+
+func findMatches(runes []rune, personal map[string]bool) []patternMatch {
+	n := len(runes)
+	lower := []rune(strings.ToLower(string(runes)))
+	matches := []patternMatch{}
+
+	for i := 0; i < n; i++ {
+		for j := i + 3; j <= n; j++ {
+			word := string(lower[i:j])
+			if rank, warning, ok := dictionaryRank(word, personal); ok {
+				matches = append(matches, patternMatch{
+					start: i, end: j,
+					guesses: rank * capitalizationGuesses(runes[i:j]),
+					warning: warning,
+				})
+			}
+
+			if j-i >= 4 && isKeyboardWalk(word) {
+				matches = append(matches, patternMatch{
+					start: i, end: j,
+					guesses: 40 * float64(j-i),
+					warning: "Straight rows of keys are easy to guess",
+				})
+			}
+			if j-i == 4 && isRecentYear(word) {
+				matches = append(matches, patternMatch{
+					start: i, end: j,
+					guesses: 120,
+					warning: "Years are easy to guess",
+				})
+			}
+		}
+	}
+
+	// Runs of one repeated character, and sequences like "abcd" or "9876".
+	for i := 0; i < n; {
+		j := i + 1
+		for j < n && lower[j] == lower[i] {
+			j++
+		}
+		if j-i >= 3 {
+			matches = append(matches, patternMatch{
+				start: i, end: j,
+				guesses: bruteForceCardinality(lower[i]) * float64(j-i),
+				warning: `Repeats like "aaa" are easy to guess`,
+			})
+		}
+		i = j
+	}
+	for i := 0; i+2 < n; {
+		delta := lower[i+1] - lower[i]
+		j := i + 1
+		for j < n && lower[j]-lower[j-1] == delta && (delta == 1 || delta == -1) {
+			j++
+		}
+		if j-i >= 3 {
+			base := bruteForceCardinality(lower[i])
+			if strings.ContainsRune("a019z", lower[i]) {
+				base = 4
+			}
+			if delta < 0 {
+				base *= 2
+			}
+			matches = append(matches, patternMatch{
+				start: i, end: j,
+				guesses: base * float64(j-i),
+				warning: `Sequences like "abc" or "6543" are easy to guess`,
+			})
+			i = j - 1
+			continue
+		}
+		i++
+	}
+	return matches
+}
+
+// capitalizationGuesses is how much capitals multiply the guesses for a word:
+// not at all when it's all lower case, a little when it's capitalized or all
+// upper case the obvious ways.
+func capitalizationGuesses(word []rune) float64 {
+	upper := 0
+	for _, r := range word {
+		if unicode.IsUpper(r) {
+			upper++
+		}
+	}
+	switch {
+	case upper == 0:
+		return 1
+	case upper == len(word), upper == 1 && unicode.IsUpper(word[0]):
+		return 2
+	default:
+		return math.Pow(2, float64(min(upper, len(word)-upper)))
+	}
+}
+
+func isKeyboardWalk(word string) bool {
+	for _, row := range keyboardRows {
+		if strings.Contains(row, word) || strings.Contains(reverse(row), word) {
+			return true
+		}
+	}
+	return false
+}
+
+func isRecentYear(word string) bool {
+	return (strings.HasPrefix(word, "19") || strings.HasPrefix(word, "20")) &&
+		strings.Trim(word, "0123456789") == ""
+}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
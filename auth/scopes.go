@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// Scopes limit what a credential may be used for. Reading chirps needs no
+// credential at all, so there is no scope for it.
+const (
+	ScopeChirpsWrite = "chirps:write"
+	// ScopeAccount covers the account itself: profile, password, two-factor
+	// authentication, sessions and API keys.
+	ScopeAccount = "account"
+)
+
+// AllScopes is what logging in grants unless narrower scopes are asked for.
+var AllScopes = []string{ScopeChirpsWrite, ScopeAccount}
+
+// APIKeyScopes are the scopes a personal API key may have. A leaked key can't
+// take over the account.
+var APIKeyScopes = []string{ScopeChirpsWrite}
+
+var ErrScopeNotGranted = errors.New("scope not granted")
+
+// NarrowScopes returns requested, without duplicates, if every scope in it is
+// one of granted, and all of granted if nothing was requested. Credentials
+// can only ever be narrowed this way, never widened.
+func NarrowScopes(granted []string, requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return granted, nil
+	}
+	scopes := []string{}
+	for _, scope := range requested {
+		if !slices.Contains(granted, scope) {
+			return nil, fmt.Errorf("%w: %s", ErrScopeNotGranted, scope)
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+func WithScopes(ctx context.Context, scopes []string) context.Context {
+	return context.WithValue(ctx, scopesKey, scopes)
+}
+
+// ScopesFromContext returns the scopes of the credential RequireUser
+// accepted.
+func ScopesFromContext(ctx context.Context) []string {
+	scopes, _ := ctx.Value(scopesKey).([]string)
+	return scopes
+}
+
+// RequireScope rejects requests whose credential lacks scope with 403. It
+// must be wrapped in RequireUser.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !slices.Contains(ScopesFromContext(r.Context()), scope) {
+				writeError(w, http.StatusForbidden, fmt.Errorf("missing scope: %s", scope))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/creighbattle/chirpy/database"
+)
+
+type commandEnv struct {
+	dbDriver string
+	dbPath   string
+	adminKey string
+}
+
+const defaultServerURL = "http://localhost:8080"
+
+func runCommand(name string, args []string, env commandEnv) error {
+	switch name {
+	case "migrate":
+		return commandMigrate(args, env)
+	case "backup":
+		return commandBackup(args, env)
+	case "restore":
+		return commandRestore(args, env)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+func commandMigrate(args []string, env commandEnv) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "print the migrations that would run without changing anything")
+	flags.Parse(args)
+
+	if env.dbDriver != "" && env.dbDriver != "json" {
+		return fmt.Errorf("migrate only applies to the json driver; %s databases are migrated on startup", env.dbDriver)
+	}
+
+	steps, err := database.Migrate(env.dbPath, *dryRun)
+	if err != nil {
+		return err
+	}
+	if len(steps) == 0 {
+		fmt.Printf("%s is up to date\n", env.dbPath)
+		return nil
+	}
+
+	for _, step := range steps {
+		if *dryRun {
+			fmt.Printf("would apply %s\n", step)
+		} else {
+			fmt.Printf("applied %s\n", step)
+		}
+	}
+	return nil
+}
+
+// commandBackup and commandRestore talk to a running server's admin
+// endpoints rather than opening the database, so they are safe to use while
+// it is serving traffic.
+
+func commandBackup(args []string, env commandEnv) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	serverURL := flags.String("url", defaultServerURL, "base URL of the running chirpy server")
+	output := flags.String("o", "", "file to write the backup to (default stdout)")
+	flags.Parse(args)
+
+	res, err := adminRequest(http.MethodGet, *serverURL+"/admin/backup", env.adminKey, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if *output == "" {
+		_, err = io.Copy(os.Stdout, res.Body)
+		return err
+	}
+
+	f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, res.Body)
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func commandRestore(args []string, env commandEnv) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	serverURL := flags.String("url", defaultServerURL, "base URL of the running chirpy server")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: chirpy restore [-url URL] BACKUP_FILE")
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	res, err := adminRequest(http.MethodPost, *serverURL+"/admin/restore", env.adminKey, f)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	fmt.Printf("restored %s\n", flags.Arg(0))
+	return nil
+}
+
+func adminRequest(method string, url string, adminKey string, body io.Reader) (*http.Response, error) {
+	if adminKey == "" {
+		return nil, errors.New("ADMIN_KEY must be set")
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "ApiKey "+adminKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, url, res.Status, strings.TrimSpace(string(msg)))
+	}
+	return res, nil
+}
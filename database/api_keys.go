@@ -0,0 +1,86 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// APIKey is a long-lived credential a user creates for a bot or script, good
+// only for its Scopes. Like refresh tokens, only a SHA-256 of the key is
+// kept, see HashToken. ID identifies the key to its owner without revealing
+// it.
+type APIKey struct {
+	ID         string     `json:"id"`
+	KeyHash    string     `json:"key_hash"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+func (db *DB) CreateAPIKey(key APIKey) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[key.UserID]; !ok {
+			return fmt.Errorf("user %w", ErrNotFound)
+		}
+		if _, ok := dbStructure.APIKeys[key.KeyHash]; ok {
+			return fmt.Errorf("api key %w", ErrAlreadyExists)
+		}
+
+		dbStructure.putAPIKey(key)
+		return nil
+	})
+}
+
+func (db *DB) GetAPIKey(keyHash string) (APIKey, error) {
+	key := APIKey{}
+	err := db.view(func(dbStructure *DBStructure) error {
+		var ok bool
+		key, ok = dbStructure.APIKeys[keyHash]
+		if !ok {
+			return fmt.Errorf("api key %w", ErrNotFound)
+		}
+		return nil
+	})
+	return key, err
+}
+
+func (db *DB) GetUserAPIKeys(userID int) ([]APIKey, error) {
+	keys := []APIKey{}
+	err := db.view(func(dbStructure *DBStructure) error {
+		for _, key := range dbStructure.APIKeys {
+			if key.UserID == userID {
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// TouchAPIKey records that the key was just used.
+func (db *DB) TouchAPIKey(keyHash string, usedAt time.Time) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		key, ok := dbStructure.APIKeys[keyHash]
+		if !ok {
+			return fmt.Errorf("api key %w", ErrNotFound)
+		}
+		key.LastUsedAt = &usedAt
+		dbStructure.putAPIKey(key)
+		return nil
+	})
+}
+
+func (db *DB) DeleteAPIKey(userID int, id string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		for keyHash, key := range dbStructure.APIKeys {
+			if key.UserID == userID && key.ID == id {
+				dbStructure.deleteAPIKey(keyHash)
+				return nil
+			}
+		}
+		return fmt.Errorf("api key %w", ErrNotFound)
+	})
+}
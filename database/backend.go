@@ -0,0 +1,461 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+type backend interface {
+	String() string
+	recover() error
+	load() (DBStructure, error)
+	snapshot(dbStructure DBStructure) error
+	commit(dbStructure DBStructure, changes []walRecord) error
+	version() (backendVersion, error)
+	migrate(dryRun bool) ([]string, error)
+}
+
+// backendVersion identifies the on-disk state so DB can tell when something
+// other than itself has written to it.
+type backendVersion struct {
+	snapshotModTime int64
+	snapshotSize    int64
+	logModTime      int64
+	logSize         int64
+}
+
+const defaultCompactThreshold = 4 << 20
+
+// fileBackend stores a JSON snapshot at path plus a write-ahead log of
+// changes made since the snapshot at path+".log". Commits only append to the
+// log; once it grows past compactThreshold bytes the current state is written
+// out as a new snapshot and the log is dropped.
+//
+// Every snapshot gets the next generation number and the log starts with a
+// walHeader naming the generation it was started for. A log whose generation
+// differs from the snapshot's is left over from an older snapshot and is
+// ignored.
+type fileBackend struct {
+	path             string
+	compactThreshold int64
+	// generation is that of the snapshot last loaded or written.
+	generation int
+}
+
+func (b *fileBackend) String() string {
+	return b.path
+}
+
+func (b *fileBackend) tempPath() string {
+	return b.path + ".tmp"
+}
+
+func (b *fileBackend) logPath() string {
+	return b.path + ".log"
+}
+
+func (b *fileBackend) load() (DBStructure, error) {
+	dat, err := os.ReadFile(b.path)
+	if err != nil {
+		return DBStructure{}, err
+	}
+	dbStructure, err := decodeDB(dat)
+	if err != nil {
+		return DBStructure{}, err
+	}
+	// The generation belongs to the file, not to the data, so it is not
+	// carried into backups.
+	b.generation = dbStructure.Generation
+	dbStructure.Generation = 0
+
+	err = b.replay(dbStructure.apply)
+	if err != nil {
+		return DBStructure{}, err
+	}
+	return dbStructure, nil
+}
+
+// migrate brings the files up to the current schema version, first copying
+// them to path.v<N>.bak (and the log to path.log.v<N>.bak) so the old
+// version can be restored by hand. With dryRun set it only reports the steps.
+func (b *fileBackend) migrate(dryRun bool) ([]string, error) {
+	dat, err := os.ReadFile(b.path)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]any{}
+	err = json.Unmarshal(dat, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	generation, ok := raw["generation"].(float64)
+	if raw["generation"] != nil && !ok {
+		return nil, fmt.Errorf("%w: generation is %v", ErrCorrupt, raw["generation"])
+	}
+	b.generation = int(generation)
+	err = b.replay(func(r walRecord) error {
+		return applyRaw(raw, r)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := rawSchemaVersion(raw)
+	if err != nil {
+		return nil, err
+	}
+	steps, err := migrateRaw(raw)
+	if err != nil || len(steps) == 0 {
+		return steps, err
+	}
+	dbStructure, err := decodeRaw(raw)
+	if err != nil {
+		return steps, err
+	}
+	if dryRun {
+		return steps, nil
+	}
+
+	suffix := fmt.Sprintf(".v%d.bak", version)
+	err = copyFile(b.path, b.path+suffix)
+	if err != nil {
+		return steps, err
+	}
+	err = copyFile(b.logPath(), b.logPath()+suffix)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return steps, err
+	}
+
+	return steps, b.snapshot(dbStructure)
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (b *fileBackend) version() (backendVersion, error) {
+	v := backendVersion{}
+	info, err := os.Stat(b.path)
+	if err != nil {
+		return v, err
+	}
+	v.snapshotModTime = info.ModTime().UnixNano()
+	v.snapshotSize = info.Size()
+
+	info, err = os.Stat(b.logPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return v, nil
+	}
+	if err != nil {
+		return v, err
+	}
+	v.logModTime = info.ModTime().UnixNano()
+	v.logSize = info.Size()
+	return v, nil
+}
+
+// replay applies the log's records, unless the log belongs to another
+// generation than the snapshot.
+func (b *fileBackend) replay(apply func(walRecord) error) error {
+	f, err := os.Open(b.logPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A trailing line without a newline is a torn append; recover
+			// trims it at startup and it was never acknowledged.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if n == 1 {
+			generation, isHeader, err := parseLogHeader(line)
+			if err != nil {
+				return fmt.Errorf("%w: %s line 1: %v", ErrCorrupt, b.logPath(), err)
+			}
+			if generation != b.generation {
+				log.Printf("Ignoring %s: it continues generation %d, the snapshot is generation %d", b.logPath(), generation, b.generation)
+				return nil
+			}
+			if isHeader {
+				continue
+			}
+		}
+
+		r := walRecord{}
+		err = json.Unmarshal(line, &r)
+		if err == nil {
+			err = apply(r)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s line %d: %v", ErrCorrupt, b.logPath(), n, err)
+		}
+	}
+}
+
+func (b *fileBackend) commit(dbStructure DBStructure, changes []walRecord) error {
+	buf := bytes.Buffer{}
+	for _, r := range changes {
+		dat, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf.Write(dat)
+		buf.WriteByte('\n')
+	}
+
+	f, err := os.OpenFile(b.logPath(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset := info.Size()
+
+	if offset > 0 {
+		// Appending to a stale log would lose the records on replay.
+		line, err := bufio.NewReader(io.NewSectionReader(f, 0, offset)).ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		generation, _, err := parseLogHeader(line)
+		if err != nil || generation != b.generation {
+			log.Printf("Discarding stale log %s", b.logPath())
+			err = f.Truncate(0)
+			if err != nil {
+				return err
+			}
+			offset = 0
+		}
+	}
+	dat := buf.Bytes()
+	if offset == 0 {
+		header, err := json.Marshal(walHeader{Generation: b.generation})
+		if err != nil {
+			return err
+		}
+		dat = append(append(header, '\n'), dat...)
+	}
+
+	_, err = f.Write(dat)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Truncate(offset)
+		return err
+	}
+
+	if offset+int64(len(dat)) < b.compactThreshold {
+		return nil
+	}
+	return b.snapshot(dbStructure)
+}
+
+// snapshot replaces the snapshot file atomically: the new contents are
+// written and fsynced to a temp file next to it, which is then renamed over
+// the old file. A crash leaves either the old or the new snapshot, never a
+// partial one. The log is removed afterwards. If that step is lost to a
+// crash, the log is still there but names the previous generation, so it is
+// not replayed over the new snapshot and the next commit starts it afresh.
+func (b *fileBackend) snapshot(dbStructure DBStructure) error {
+	dbStructure.Generation = b.generation + 1
+	dat, err := json.Marshal(dbStructure)
+	if err != nil {
+		return err
+	}
+
+	tmp := b.tempPath()
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(dat)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, b.path)
+	if err != nil {
+		return err
+	}
+	b.generation = dbStructure.Generation
+	err = syncDir(filepath.Dir(b.path))
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(b.logPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// recover cleans up after a crash. A temp file that is complete JSON was
+// fsynced before the crash and is newer than the snapshot, so it is moved into
+// place; anything else is discarded. A torn record at the end of the log is
+// trimmed so later appends start on a fresh line.
+func (b *fileBackend) recover() error {
+	err := b.recoverSnapshot()
+	if err != nil {
+		return err
+	}
+	return b.recoverLog()
+}
+
+func (b *fileBackend) recoverSnapshot() error {
+	tmp := b.tempPath()
+	dat, err := os.ReadFile(tmp)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !json.Valid(dat) {
+		log.Printf("Discarding incomplete database write %s", tmp)
+		return os.Remove(tmp)
+	}
+
+	log.Printf("Recovering database %s from %s", b.path, tmp)
+	err = os.Rename(tmp, b.path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(b.path))
+}
+
+func (b *fileBackend) recoverLog() error {
+	dat, err := os.ReadFile(b.logPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	end := bytes.LastIndexByte(dat, '\n') + 1
+	if end == len(dat) {
+		return nil
+	}
+
+	log.Printf("Discarding torn record at the end of %s", b.logPath())
+	return os.Truncate(b.logPath(), int64(end))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	err = d.Sync()
+	if err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
+
+func decodeDB(dat []byte) (DBStructure, error) {
+	dbStructure := DBStructure{}
+	err := json.Unmarshal(dat, &dbStructure)
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	dbStructure.initMaps()
+	return dbStructure, nil
+}
+
+// memoryBackend keeps an encoded copy of the database in memory, standing in
+// for the file DB reloads from after a failed update.
+type memoryBackend struct {
+	dat []byte
+}
+
+func (b *memoryBackend) String() string {
+	return "memory"
+}
+
+func (b *memoryBackend) recover() error {
+	return nil
+}
+
+func (b *memoryBackend) load() (DBStructure, error) {
+	if b.dat == nil {
+		return DBStructure{}, os.ErrNotExist
+	}
+	return decodeDB(b.dat)
+}
+
+func (b *memoryBackend) snapshot(dbStructure DBStructure) error {
+	dat, err := json.Marshal(dbStructure)
+	if err != nil {
+		return err
+	}
+	b.dat = dat
+	return nil
+}
+
+func (b *memoryBackend) commit(dbStructure DBStructure, changes []walRecord) error {
+	return b.snapshot(dbStructure)
+}
+
+func (b *memoryBackend) version() (backendVersion, error) {
+	return backendVersion{}, nil
+}
+
+func (b *memoryBackend) migrate(dryRun bool) ([]string, error) {
+	return nil, nil
+}
@@ -0,0 +1,110 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A crash between writing a snapshot and removing the log leaves the old log
+// behind. It must not be replayed over the new snapshot.
+func TestStaleLogAfterRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateUser("kept@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup := bytes.Buffer{}
+	err = db.Backup(&backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateUser("stale@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	staleLog, err := os.ReadFile(path + ".log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Restore(&backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path+".log", staleLog, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetUserByEmail("stale@example.com")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("stale log was replayed: got %v, want ErrNotFound", err)
+	}
+
+	// The next commit must not append to the stale log, or it would be
+	// ignored along with it.
+	_, err = db.CreateUser("new@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range []string{"kept@example.com", "new@example.com"} {
+		_, err = db.GetUserByEmail(email)
+		if err != nil {
+			t.Errorf("%s: %v", email, err)
+		}
+	}
+	_, err = db.GetUserByEmail("stale@example.com")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("stale log was replayed after a commit: got %v, want ErrNotFound", err)
+	}
+}
+
+// Files written before generations were introduced have neither a generation
+// in the snapshot nor a header in the log.
+func TestLogWithoutHeaderIsReplayed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := bytes.Buffer{}
+	err = db.Backup(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, snapshot.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path+".log", []byte(
+		`{"op":"put","collection":"users","key":"1","value":{"id":1,"email":"old@example.com"}}`+"\n"+
+			`{"op":"put","collection":"emails","key":"old@example.com","value":1}`+"\n"+
+			`{"op":"put","collection":"sequences","key":"users","value":1}`+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetUserByEmail("old@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,137 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrInvalidBackup = errors.New("invalid backup")
+
+// Backups are a DBStructure encoded as JSON, whatever the backend, so a
+// backup taken from one driver can be restored into another.
+
+func (db *DB) Backup(w io.Writer) error {
+	db.mu.RLock()
+	dat, err := json.Marshal(db.cache)
+	db.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(dat)
+	return err
+}
+
+func (db *DB) Restore(r io.Reader) error {
+	dbStructure, err := readBackup(r)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	err = db.backend.snapshot(dbStructure)
+	if err != nil {
+		return err
+	}
+	return db.reload()
+}
+
+// readBackup decodes a backup, upgrading it if it was taken with an older
+// schema, and checks that it is internally consistent.
+func readBackup(r io.Reader) (DBStructure, error) {
+	raw := map[string]any{}
+	err := json.NewDecoder(r).Decode(&raw)
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+
+	_, err = migrateRaw(raw)
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	dbStructure, err := decodeRaw(raw)
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+
+	err = dbStructure.validate()
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	return dbStructure, nil
+}
+
+func (s *DBStructure) validate() error {
+	for id, user := range s.Users {
+		if user.ID != id {
+			return fmt.Errorf("user %d is stored under key %d", user.ID, id)
+		}
+		if s.Emails[user.Email] != id {
+			return fmt.Errorf("email of user %d is not indexed", id)
+		}
+		if id > s.Sequences["users"] {
+			return fmt.Errorf("user %d is beyond the users sequence", id)
+		}
+	}
+	for email, id := range s.Emails {
+		if s.Users[id].Email != email {
+			return fmt.Errorf("email %q points at user %d which does not have it", email, id)
+		}
+	}
+	for id, chirp := range s.Chirps {
+		if chirp.ID != id {
+			return fmt.Errorf("chirp %d is stored under key %d", chirp.ID, id)
+		}
+		if _, ok := s.Users[chirp.AuthorID]; !ok {
+			return fmt.Errorf("chirp %d has unknown author %d", id, chirp.AuthorID)
+		}
+		if id > s.Sequences["chirps"] {
+			return fmt.Errorf("chirp %d is beyond the chirps sequence", id)
+		}
+	}
+	for key, token := range s.RefreshTokens {
+		if token.TokenHash != key {
+			return errors.New("refresh token is stored under the wrong key")
+		}
+		if _, ok := s.Users[token.UserID]; !ok {
+			return fmt.Errorf("refresh token has unknown user %d", token.UserID)
+		}
+	}
+	for id, token := range s.RevokedTokens {
+		if token.ID != id {
+			return fmt.Errorf("revoked token %s is stored under key %s", token.ID, id)
+		}
+		if _, ok := s.Users[token.UserID]; !ok {
+			return fmt.Errorf("revoked token %s has unknown user %d", id, token.UserID)
+		}
+	}
+	for key, token := range s.OneTimeTokens {
+		if token.TokenHash != key {
+			return errors.New("one-time token is stored under the wrong key")
+		}
+		if _, ok := s.Users[token.UserID]; !ok {
+			return fmt.Errorf("one-time token has unknown user %d", token.UserID)
+		}
+	}
+	for key, identity := range s.Identities {
+		if identityKey(identity.Provider, identity.Subject) != key {
+			return fmt.Errorf("identity %s is stored under the wrong key", key)
+		}
+		if _, ok := s.Users[identity.UserID]; !ok {
+			return fmt.Errorf("identity %s has unknown user %d", key, identity.UserID)
+		}
+	}
+	for keyHash, key := range s.APIKeys {
+		if key.KeyHash != keyHash {
+			return fmt.Errorf("api key %s is stored under the wrong hash", key.ID)
+		}
+		if _, ok := s.Users[key.UserID]; !ok {
+			return fmt.Errorf("api key %s has unknown user %d", key.ID, key.UserID)
+		}
+	}
+	return nil
+}
@@ -1,39 +1,79 @@
 package database
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"os"
 	"sync"
-
-	"golang.org/x/crypto/bcrypt"
+	"time"
 )
 
+// DB is the file-backed Store. The whole database is kept in memory and
+// reads are served from there; the backend is only touched on writes.
 type DB struct {
-	path string
-	mu   *sync.RWMutex
+	backend        backend
+	mu             *sync.RWMutex
+	cache          *DBStructure
+	version        backendVersion
+	reloadOnChange bool
 }
 
 type DBStructure struct {
-	Chirps map[int]Chirp `json:"chirps"`
-	Users map[int]User `json:"users"`
+	SchemaVersion int `json:"schema_version"`
+	// Generation counts the snapshots the file backend has written. The log
+	// records the generation it continues from, so a log left over from an
+	// older snapshot is never replayed over a newer one.
+	Generation int `json:"generation,omitempty"`
+
+	Chirps map[int]Chirp  `json:"chirps"`
+	Users  map[int]User   `json:"users"`
 	Emails map[string]int `json:"emails"`
+	// Sequences holds the last ID handed out per collection, so IDs are
+	// never reused after a delete.
+	Sequences map[string]int `json:"sequences"`
+	// RefreshTokens is keyed by the token's hash.
+	RefreshTokens map[string]RefreshToken `json:"refresh_tokens"`
+	// RevokedTokens is the access token denylist, keyed by the token's jti.
+	RevokedTokens map[string]RevokedToken `json:"revoked_tokens"`
+	// OneTimeTokens is keyed by the token's hash.
+	OneTimeTokens map[string]OneTimeToken `json:"one_time_tokens"`
+	// Identities is keyed by "<provider>:<subject>".
+	Identities map[string]Identity `json:"identities"`
+	// APIKeys is keyed by the key's hash.
+	APIKeys map[string]APIKey `json:"api_keys"`
+
+	changes []walRecord
 }
 
 type User struct {
-	ID int `json:"id"`
-	Email string `json:"email"`
-	Password string `json:"password"`
-	RefreshToken string `json:"refresh_token"`
-	Exp string `json:"exp"`
-	IsChirpyRed bool `json:"is_chirpy_red"`
+	ID            int    `json:"id"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Password      string `json:"password"`
+	IsChirpyRed   bool   `json:"is_chirpy_red"`
+
+	// TOTPSecret is set from two-factor setup on, but only checked once
+	// TOTPEnabled. TOTPLastStep is the time step of the last code used, and
+	// RecoveryCodes holds the hashes of the unused recovery codes.
+	TOTPSecret    string   `json:"totp_secret,omitempty"`
+	TOTPEnabled   bool     `json:"totp_enabled"`
+	TOTPLastStep  int64    `json:"totp_last_step,omitempty"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+
+	// FailedLogins counts failed login attempts since the last successful
+	// one, the last of them at LastFailedLogin. Once there are enough,
+	// LockedUntil refuses logins for a while.
+	FailedLogins    int        `json:"failed_logins,omitempty"`
+	LastFailedLogin *time.Time `json:"last_failed_login,omitempty"`
+	LockedUntil     *time.Time `json:"locked_until,omitempty"`
 }
 
 type UserResponse struct {
-	ID int `json:"id"`
-	Email string `json:"email"`
-	IsChirpyRed bool `json:"is_chirpy_red"`
+	ID            int    `json:"id"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	IsChirpyRed   bool   `json:"is_chirpy_red"`
 }
 
 
@@ -43,281 +83,430 @@ type Chirp struct {
 	AuthorID int `json:"author_id"`
 }
 
-func NewDB(path string) (*DB, error) {
-	db := &DB{
-		path: path,
-		mu:   &sync.RWMutex{},
-	}
-	err := db.ensureDB()
-	return db, err
+type options struct {
+	compactThreshold int64
+	reloadOnChange   bool
 }
 
-func (db *DB) CreateUser(body string, password string) (UserResponse, error) {
-	dbStructure, err := db.LoadDB()
-	if err != nil {
-		return UserResponse{}, err
-	}
+type Option func(*options)
 
-	bcryptPassword, err := bcrypt.GenerateFromPassword([]byte(password), 0)
-	if err != nil {
-		return UserResponse{}, err
+// WithCompactThreshold sets the size in bytes the write-ahead log may reach
+// before it is folded into a new snapshot.
+func WithCompactThreshold(n int64) Option {
+	return func(o *options) {
+		o.compactThreshold = n
 	}
+}
 
-	id := len(dbStructure.Users) + 1
-	user := User{
-		ID:   id,
-		Email: body,
-		Password: string(bcryptPassword),
+// WithReloadOnChange makes the DB check the modification time and size of its
+// files before every operation and reload them if something else changed them.
+func WithReloadOnChange() Option {
+	return func(o *options) {
+		o.reloadOnChange = true
 	}
+}
 
-	_, ok := dbStructure.Emails[body]
-	if ok {
-		return UserResponse{}, errors.New("email already exists")
+func NewDB(path string, opts ...Option) (*DB, error) {
+	o := options{
+		compactThreshold: defaultCompactThreshold,
 	}
-	dbStructure.Emails[body] = id
-	dbStructure.Users[id] = user
-
-	err = db.writeDB(dbStructure)
-	if err != nil {
-		return UserResponse{}, err
+	for _, opt := range opts {
+		opt(&o)
 	}
 
-	return UserResponse{Email: body, ID: id, IsChirpyRed: false}, nil
+	db := &DB{
+		backend: &fileBackend{
+			path:             path,
+			compactThreshold: o.compactThreshold,
+		},
+		mu:             &sync.RWMutex{},
+		reloadOnChange: o.reloadOnChange,
+	}
+	err := db.ensureDB()
+	return db, err
 }
 
-func (db *DB) UpdateUser(updatedEmail string, password string, id int) (UserResponse, error) {
-	dbStructure, err := db.LoadDB()
-	if err != nil {
-		return UserResponse{}, err
+func NewMemoryDB() *DB {
+	db := &DB{
+		backend: &memoryBackend{},
+		mu:      &sync.RWMutex{},
 	}
+	db.createDB()
+	return db
+}
+
+func (db *DB) CreateUser(body string, passwordHash string) (UserResponse, error) {
+	id := 0
+	err := db.update(func(dbStructure *DBStructure) error {
+		_, ok := dbStructure.Emails[body]
+		if ok {
+			return fmt.Errorf("email %w", ErrAlreadyExists)
+		}
 
-	bcryptPassword, err := bcrypt.GenerateFromPassword([]byte(password), 0)
+		id = dbStructure.nextID("users")
+		dbStructure.putEmail(body, id)
+		dbStructure.putUser(User{
+			ID:       id,
+			Email:    body,
+			Password: passwordHash,
+		})
+		return nil
+	})
 	if err != nil {
 		return UserResponse{}, err
 	}
 
-	allEmails := dbStructure.Emails
-	user := dbStructure.Users[id]
-
-	_, ok := allEmails[updatedEmail]
-	if ok {
-		return UserResponse{}, errors.New("email already exists")
-	}
+	return UserResponse{Email: body, ID: id, IsChirpyRed: false}, nil
+}
 
-	delete(allEmails, user.Email)
-	allEmails[updatedEmail] = user.ID
+func (db *DB) UpdateUser(updatedEmail string, passwordHash string, id int) (UserResponse, error) {
+	user := User{}
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		user, ok = dbStructure.Users[id]
+		if !ok {
+			return fmt.Errorf("user %w", ErrNotFound)
+		}
 
-	user.Email = updatedEmail
-	user.Password = string(bcryptPassword)
+		// A new address has to be verified again.
+		if updatedEmail != user.Email {
+			_, ok = dbStructure.Emails[updatedEmail]
+			if ok {
+				return fmt.Errorf("email %w", ErrAlreadyExists)
+			}
 
-	dbStructure.Users[id] = user
-	dbStructure.Emails = allEmails
+			dbStructure.deleteEmail(user.Email)
+			dbStructure.putEmail(updatedEmail, user.ID)
+			user.Email = updatedEmail
+			user.EmailVerified = false
+		}
 
-	err = db.writeDB(dbStructure)
+		user.Password = passwordHash
+		dbStructure.putUser(user)
+		return nil
+	})
 	if err != nil {
 		return UserResponse{}, err
 	}
 
-	return UserResponse{Email: updatedEmail, ID: id}, nil
+	return UserResponse{Email: user.Email, ID: id, EmailVerified: user.EmailVerified, IsChirpyRed: user.IsChirpyRed}, nil
 }
 
+func (db *DB) UpdateUserPassword(id int, passwordHash string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[id]
+		if !ok {
+			return fmt.Errorf("user %w", ErrNotFound)
+		}
 
-func (db *DB) UpdateUserSubscription(userId int) error {
-
-	dbStructure, err := db.LoadDB()
-	if err != nil {
-		return err
-	}
-
-	users := dbStructure.Users
-	user, ok := users[userId]
-	if !ok {
-		return errors.New("no user")
-	}
+		user.Password = passwordHash
+		dbStructure.putUser(user)
+		return nil
+	})
+}
 
-	user.IsChirpyRed = true
-	dbStructure.Users[userId] = user
+// ReplacePasswordHash swaps in a new hash of the same password, unless the
+// password has been changed since oldHash was read.
+func (db *DB) ReplacePasswordHash(id int, oldHash string, newHash string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[id]
+		if !ok || user.Password != oldHash {
+			return fmt.Errorf("user with that password hash %w", ErrNotFound)
+		}
 
-	err = db.writeDB(dbStructure)
-	if err != nil {
-		fmt.Println("running here")
-		fmt.Println(err)
-		return err
-	}
+		user.Password = newHash
+		dbStructure.putUser(user)
+		return nil
+	})
+}
 
-	return nil
+// SetEmailVerified marks the user's email as verified, provided it is still
+// email; otherwise the verification was for an address they have since
+// replaced and ErrNotFound is returned.
+func (db *DB) SetEmailVerified(id int, email string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[id]
+		if !ok || user.Email != email {
+			return fmt.Errorf("user with email %w", ErrNotFound)
+		}
 
+		user.EmailVerified = true
+		dbStructure.putUser(user)
+		return nil
+	})
 }
 
-func (db *DB) UpdateRefreshToken (id int, token string, exp string) error {
-	dbStructure, err := db.LoadDB()
-	if err != nil {
-		return err
-	}
+func (db *DB) UpdateUserSubscription(userId int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[userId]
+		if !ok {
+			return fmt.Errorf("user %w", ErrNotFound)
+		}
 
-	user := dbStructure.Users[id]
-	user.RefreshToken = token
-	user.Exp = exp
+		user.IsChirpyRed = true
+		dbStructure.putUser(user)
+		return nil
+	})
+}
 
-	dbStructure.Users[id] = user
+func (db *DB) GetUser(id int) (User, error) {
+	user := User{}
+	err := db.view(func(dbStructure *DBStructure) error {
+		u, ok := dbStructure.Users[id]
+		if !ok {
+			return fmt.Errorf("user %w", ErrNotFound)
+		}
+		user = u
+		return nil
+	})
+	return user, err
+}
 
-	err = db.writeDB(dbStructure)
-	if err != nil {
-		return err
-	}
+func (db *DB) GetUserByEmail(email string) (User, error) {
+	user := User{}
+	err := db.view(func(dbStructure *DBStructure) error {
+		id, ok := dbStructure.Emails[email]
+		if !ok {
+			return fmt.Errorf("email %w", ErrNotFound)
+		}
 
-	return nil
+		u, ok := dbStructure.Users[id]
+		if !ok {
+			return fmt.Errorf("user %w", ErrNotFound)
+		}
+		user = u
+		return nil
+	})
+	return user, err
+}
 
+func (db *DB) GetUsers() ([]User, error) {
+	users := []User{}
+	err := db.view(func(dbStructure *DBStructure) error {
+		for _, user := range dbStructure.Users {
+			users = append(users, user)
+		}
+		return nil
+	})
+	return users, err
 }
 
-func (db *DB) RevokeRefreshToken (refreshToken string) error {
-	dbStructure, err := db.LoadDB()
+func (db *DB) CreateChirp(body string, authorID int) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.update(func(dbStructure *DBStructure) error {
+		id := dbStructure.nextID("chirps")
+		chirp = Chirp{
+			ID:       id,
+			Body:     body,
+			AuthorID: authorID,
+		}
+		dbStructure.putChirp(chirp)
+		return nil
+	})
 	if err != nil {
-		return err
+		return Chirp{}, err
 	}
 
-	users := dbStructure.Users
+	return chirp, nil
+}
 
-	for _, user := range users {
-		if user.RefreshToken == refreshToken {	
-			user.RefreshToken = ""
-			dbStructure.Users[user.ID] = user
-			err = db.writeDB(dbStructure)
-			if err != nil {
-				return err
-			}
-			return nil
+func (db *DB) DeleteChirp(id int, chirpId int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		chirp, ok := dbStructure.Chirps[chirpId]
+		if !ok {
+			return fmt.Errorf("chirp %w", ErrNotFound)
+		}
+		if chirp.AuthorID != id {
+			return ErrForbidden
 		}
-	}
-
-	return errors.New("refresh token does not exist")
 
+		dbStructure.deleteChirp(chirpId)
+		return nil
+	})
 }
 
-
-func (db *DB) GetUsers() ([]User, error) {
-	dbStructure, err := db.LoadDB()
-	if err != nil {
-		return nil, err
-	}
-
-	users := make([]User, 0, len(dbStructure.Users))
-	for _, user := range dbStructure.Users {
-		users = append(users, user)
-	}
-
-	return users, nil
+func (db *DB) GetChirp(id int) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.view(func(dbStructure *DBStructure) error {
+		c, ok := dbStructure.Chirps[id]
+		if !ok {
+			return fmt.Errorf("chirp %w", ErrNotFound)
+		}
+		chirp = c
+		return nil
+	})
+	return chirp, err
 }
 
-func (db *DB) CreateChirp(body string, authorID int) (Chirp, error) {
-	dbStructure, err := db.LoadDB()
-	if err != nil {
-		return Chirp{}, err
-	}
+func (db *DB) GetChirps() ([]Chirp, error) {
+	chirps := []Chirp{}
+	err := db.view(func(dbStructure *DBStructure) error {
+		for _, chirp := range dbStructure.Chirps {
+			chirps = append(chirps, chirp)
+		}
+		return nil
+	})
+	return chirps, err
+}
 
-	id := len(dbStructure.Chirps) + 1
-	chirp := Chirp{
-		ID:   id,
-		Body: body,
-		AuthorID: authorID,
-	}
-	dbStructure.Chirps[id] = chirp
+func (db *DB) createDB() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-	err = db.writeDB(dbStructure)
+	dbStructure := DBStructure{
+		SchemaVersion: currentSchemaVersion(),
+		Chirps:        map[int]Chirp{},
+		Users:         map[int]User{},
+		Emails:        map[string]int{},
+		Sequences:     map[string]int{},
+		RefreshTokens: map[string]RefreshToken{},
+		RevokedTokens: map[string]RevokedToken{},
+		OneTimeTokens: map[string]OneTimeToken{},
+		Identities:    map[string]Identity{},
+		APIKeys:       map[string]APIKey{},
+	}
+	err := db.backend.snapshot(dbStructure)
 	if err != nil {
-		return Chirp{}, err
+		return err
 	}
-
-	return chirp, nil
+	return db.reload()
 }
 
-func (db *DB) DeleteChirp(id int, chirpId int) error{
-	dbStructure, err := db.LoadDB()
+func (db *DB) ensureDB() error {
+	err := db.backend.recover()
 	if err != nil {
 		return err
 	}
 
-	chirps := dbStructure.Chirps
+	steps, err := db.backend.migrate(false)
+	for _, step := range steps {
+		log.Printf("Migrated %s: %s", db.backend, step)
+	}
+	if err == nil {
+		db.mu.Lock()
+		err = db.reload()
+		db.mu.Unlock()
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return db.createDB()
+	}
+	if errors.Is(err, ErrCorrupt) {
+		return fmt.Errorf("%s: %w; restore it from a backup or move it aside to start empty", db.backend, err)
+	}
+	return err
+}
 
-	for _, chirp := range chirps {
-		if chirpId == chirp.ID {
-			if chirp.AuthorID != id {
-				return errors.New("404")
-			}
-			delete(chirps, chirpId)
-			dbStructure.Chirps = chirps
-			err = db.writeDB(dbStructure)
-			if err != nil {
-				return err
-			}
-			return nil
+// Migrate upgrades the JSON database at path to the current schema version
+// and returns the steps taken. NewDB does this automatically; Migrate exists
+// so the steps can be previewed with dryRun, which leaves the files untouched.
+func Migrate(path string, dryRun bool) ([]string, error) {
+	b := &fileBackend{path: path}
+	if !dryRun {
+		err := b.recover()
+		if err != nil {
+			return nil, err
 		}
 	}
+	return b.migrate(dryRun)
+}
 
+// update applies fn to the cached database and commits the changes it made,
+// holding the write lock for the whole read-modify-write so concurrent updates
+// cannot interleave. Nothing is written if fn returns an error.
+func (db *DB) update(fn func(*DBStructure) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-	return nil
-} 
-
-func (db *DB) GetChirps() ([]Chirp, error) {
-	dbStructure, err := db.LoadDB()
+	err := db.reloadIfChanged()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	chirps := make([]Chirp, 0, len(dbStructure.Chirps))
-	for _, chirp := range dbStructure.Chirps {
-		chirps = append(chirps, chirp)
+	err = fn(db.cache)
+	changes := db.cache.changes
+	db.cache.changes = nil
+	if err == nil && len(changes) > 0 {
+		err = db.backend.commit(*db.cache, changes)
+		if err == nil {
+			db.version, err = db.backend.version()
+		}
 	}
-
-	return chirps, nil
-}
-
-func (db *DB) createDB() error {
-	dbStructure := DBStructure{
-		Chirps: map[int]Chirp{},
-		Users: map[int]User{},
-		Emails: map[string]int{},
+	if err != nil && len(changes) > 0 {
+		// The cache may now disagree with what is on disk; start over from
+		// the persisted state.
+		reloadErr := db.reload()
+		if reloadErr != nil {
+			log.Printf("Error reloading %s after failed update: %s", db.backend, reloadErr)
+		}
 	}
-	return db.writeDB(dbStructure)
+	return err
 }
 
-func (db *DB) ensureDB() error {
-	_, err := os.ReadFile(db.path)
-	if errors.Is(err, os.ErrNotExist) {
-		return db.createDB()
+// view runs fn against the cached database under the read lock. fn must not
+// modify it or keep references to its maps.
+func (db *DB) view(fn func(*DBStructure) error) error {
+	if db.reloadOnChange {
+		err := db.reloadIfStale()
+		if err != nil {
+			return err
+		}
 	}
-	return err
-}
 
-func (db *DB) LoadDB() (DBStructure, error) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	dbStructure := DBStructure{}
-	dat, err := os.ReadFile(db.path)
-	if errors.Is(err, os.ErrNotExist) {
-		return dbStructure, err
-	}
-	err = json.Unmarshal(dat, &dbStructure)
+	return fn(db.cache)
+}
+
+// reloadIfStale only takes the write lock when the files look changed, so
+// concurrent readers are not serialized by the check.
+func (db *DB) reloadIfStale() error {
+	version, err := db.backend.version()
 	if err != nil {
-		return dbStructure, err
+		return err
 	}
 
-	return dbStructure, nil
-}
+	db.mu.RLock()
+	stale := version != db.version
+	db.mu.RUnlock()
+	if !stale {
+		return nil
+	}
 
-func (db *DB) writeDB(dbStructure DBStructure) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	return db.reloadIfChanged()
+}
 
-	dat, err := json.Marshal(dbStructure)
+// reload and reloadIfChanged expect the caller to hold the write lock.
+func (db *DB) reload() error {
+	dbStructure, err := db.backend.load()
 	if err != nil {
 		return err
 	}
-
-	err = os.WriteFile(db.path, dat, 0600)
+	version, err := db.backend.version()
 	if err != nil {
 		return err
 	}
+
+	db.cache = &dbStructure
+	db.version = version
 	return nil
-}
\ No newline at end of file
+}
+
+func (db *DB) reloadIfChanged() error {
+	if !db.reloadOnChange {
+		return nil
+	}
+
+	version, err := db.backend.version()
+	if err != nil {
+		return err
+	}
+	if version == db.version {
+		return nil
+	}
+
+	log.Printf("Reloading %s after external modification", db.backend)
+	return db.reload()
+}
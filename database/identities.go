@@ -0,0 +1,48 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// Identity links a user to their account at an OpenID Connect provider.
+// Subject is the provider's ID for the account, which unlike the email
+// address never changes.
+type Identity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	UserID    int       `json:"user_id"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func identityKey(provider string, subject string) string {
+	return provider + ":" + subject
+}
+
+func (db *DB) CreateIdentity(identity Identity) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[identity.UserID]; !ok {
+			return fmt.Errorf("user %w", ErrNotFound)
+		}
+		if _, ok := dbStructure.Identities[identityKey(identity.Provider, identity.Subject)]; ok {
+			return fmt.Errorf("identity %w", ErrAlreadyExists)
+		}
+
+		dbStructure.putIdentity(identity)
+		return nil
+	})
+}
+
+func (db *DB) GetIdentity(provider string, subject string) (Identity, error) {
+	identity := Identity{}
+	err := db.view(func(dbStructure *DBStructure) error {
+		var ok bool
+		identity, ok = dbStructure.Identities[identityKey(provider, subject)]
+		if !ok {
+			return fmt.Errorf("identity %w", ErrNotFound)
+		}
+		return nil
+	})
+	return identity, err
+}
@@ -0,0 +1,60 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// RecordFailedLogin counts a failed login attempt against the user and
+// returns how many there have been in a row. Failures are forgotten once
+// there has been none for longer than window.
+func (db *DB) RecordFailedLogin(id int, now time.Time, window time.Duration) (int, error) {
+	failures := 0
+	err := db.update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[id]
+		if !ok {
+			return fmt.Errorf("user %w", ErrNotFound)
+		}
+
+		if user.LastFailedLogin == nil || now.Sub(*user.LastFailedLogin) > window {
+			user.FailedLogins = 0
+		}
+		now = now.UTC()
+		user.FailedLogins++
+		user.LastFailedLogin = &now
+		failures = user.FailedLogins
+		dbStructure.putUser(user)
+		return nil
+	})
+	return failures, err
+}
+
+func (db *DB) LockUser(id int, until time.Time) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[id]
+		if !ok {
+			return fmt.Errorf("user %w", ErrNotFound)
+		}
+
+		until = until.UTC()
+		user.LockedUntil = &until
+		dbStructure.putUser(user)
+		return nil
+	})
+}
+
+// UnlockUser lifts any lockout and forgets the user's failed login attempts.
+func (db *DB) UnlockUser(id int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[id]
+		if !ok {
+			return fmt.Errorf("user %w", ErrNotFound)
+		}
+
+		user.FailedLogins = 0
+		user.LastFailedLogin = nil
+		user.LockedUntil = nil
+		dbStructure.putUser(user)
+		return nil
+	})
+}
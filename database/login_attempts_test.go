@@ -0,0 +1,51 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordFailedLoginForgetsOldFailures(t *testing.T) {
+	const window = 24 * time.Hour
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := db.CreateUser("user@example.com", "hash")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Now().UTC()
+			for _, tc := range []struct {
+				at   time.Time
+				want int
+			}{
+				{start, 1},
+				{start.Add(time.Hour), 2},
+				{start.Add(time.Hour + window), 3},
+				// More than window after the last failure, so it starts over.
+				{start.Add(time.Hour + 2*window + time.Second), 1},
+				{start.Add(time.Hour + 2*window + time.Minute), 2},
+			} {
+				failures, err := db.RecordFailedLogin(user.ID, tc.at, window)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if failures != tc.want {
+					t.Fatalf("at %s: got %d failures, want %d", tc.at.Sub(start), failures, tc.want)
+				}
+			}
+
+			err = db.UnlockUser(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			failures, err := db.RecordFailedLogin(user.ID, start.Add(3*window), window)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if failures != 1 {
+				t.Fatalf("after unlocking: got %d failures, want 1", failures)
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// migration upgrades a JSON database from one schema version to the next.
+// Migrations work on the decoded JSON rather than on DBStructure so they can
+// still see fields the current types no longer have.
+type migration struct {
+	description string
+	up          func(raw map[string]any) error
+}
+
+// migrations[i] upgrades schema version i to i+1. Files written before
+// versioning existed have no schema_version and count as version 0.
+var migrations = []migration{
+	{"add per-collection ID sequences", addSequences},
+	{"move refresh tokens out of users into their own collection", splitRefreshTokens},
+	{"give every refresh token a session ID and IP", addSessionIDs},
+	{"store refresh tokens as SHA-256 hashes", hashRefreshTokens},
+	{"add the revoked access token list", addRevokedTokens},
+	{"add one-time tokens", addOneTimeTokens},
+	{"track whether users verified their email", addEmailVerified},
+	{"add two-factor authentication settings to users", addTOTP},
+	{"add OpenID Connect identities", addIdentities},
+	{"add personal API keys", addAPIKeys},
+	{"add scopes to sessions", addSessionScopes},
+}
+
+func currentSchemaVersion() int {
+	return len(migrations)
+}
+
+// migrateRaw applies every migration raw still needs, returning a line per
+// step. It does not touch the disk.
+func migrateRaw(raw map[string]any) ([]string, error) {
+	version, err := rawSchemaVersion(raw)
+	if err != nil {
+		return nil, err
+	}
+	if version > currentSchemaVersion() {
+		return nil, fmt.Errorf("database schema version %d is newer than the %d this binary supports", version, currentSchemaVersion())
+	}
+
+	steps := []string{}
+	for v := version; v < currentSchemaVersion(); v++ {
+		m := migrations[v]
+		err := m.up(raw)
+		if err != nil {
+			return steps, fmt.Errorf("migrating schema version %d to %d (%s): %w", v, v+1, m.description, err)
+		}
+		raw["schema_version"] = v + 1
+		steps = append(steps, fmt.Sprintf("schema version %d -> %d: %s", v, v+1, m.description))
+	}
+	return steps, nil
+}
+
+func rawSchemaVersion(raw map[string]any) (int, error) {
+	v, ok := raw["schema_version"]
+	if !ok {
+		return 0, nil
+	}
+	n, ok := v.(float64)
+	if !ok {
+		return 0, fmt.Errorf("%w: schema_version is %v", ErrCorrupt, v)
+	}
+	return int(n), nil
+}
+
+// decodeRaw converts a migrated database into the current types, which also
+// checks that the migrations produced something the current code can read.
+func decodeRaw(raw map[string]any) (DBStructure, error) {
+	dat, err := json.Marshal(raw)
+	if err != nil {
+		return DBStructure{}, err
+	}
+	return decodeDB(dat)
+}
+
+func rawCollection(raw map[string]any, name string) map[string]any {
+	coll, ok := raw[name].(map[string]any)
+	if !ok {
+		coll = map[string]any{}
+		raw[name] = coll
+	}
+	return coll
+}
+
+func addSequences(raw map[string]any) error {
+	sequences := rawCollection(raw, "sequences")
+	for _, name := range []string{"users", "chirps"} {
+		if _, ok := sequences[name]; ok {
+			continue
+		}
+
+		highest := 0
+		for key := range rawCollection(raw, name) {
+			id, err := strconv.Atoi(key)
+			if err != nil {
+				return fmt.Errorf("%s key %q: %w", name, key, err)
+			}
+			if id > highest {
+				highest = id
+			}
+		}
+		sequences[name] = highest
+	}
+	return nil
+}
+
+// splitRefreshTokens turns the single refresh_token/exp pair each user had
+// into an entry in refresh_tokens. Those tokens were always issued for 60
+// days, which gives their creation time.
+func splitRefreshTokens(raw map[string]any) error {
+	tokens := rawCollection(raw, "refresh_tokens")
+	for key, value := range rawCollection(raw, "users") {
+		user, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("user %s is not an object", key)
+		}
+		token, _ := user["refresh_token"].(string)
+		exp, _ := user["exp"].(string)
+		delete(user, "refresh_token")
+		delete(user, "exp")
+		if token == "" {
+			continue
+		}
+
+		expiresAt, err := time.Parse(time.RFC3339, exp)
+		if err != nil {
+			return fmt.Errorf("user %s refresh token expiry: %w", key, err)
+		}
+		createdAt := expiresAt.Add(-1440 * time.Hour)
+		tokens[token] = map[string]any{
+			"token":        token,
+			"user_id":      user["id"],
+			"device":       "",
+			"created_at":   createdAt,
+			"last_used_at": createdAt,
+			"expires_at":   expiresAt,
+		}
+	}
+	return nil
+}
+
+func addSessionIDs(raw map[string]any) error {
+	for key, value := range rawCollection(raw, "refresh_tokens") {
+		token, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("refresh token %s is not an object", key)
+		}
+
+		id := make([]byte, 16)
+		_, err := rand.Read(id)
+		if err != nil {
+			return err
+		}
+		token["id"] = hex.EncodeToString(id)
+		token["ip"] = ""
+	}
+	return nil
+}
+
+func hashRefreshTokens(raw map[string]any) error {
+	tokens := rawCollection(raw, "refresh_tokens")
+	hashed := map[string]any{}
+	for key, value := range tokens {
+		token, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("refresh token %s is not an object", key)
+		}
+
+		hash := HashToken(key)
+		delete(token, "token")
+		token["token_hash"] = hash
+		hashed[hash] = token
+	}
+	raw["refresh_tokens"] = hashed
+	return nil
+}
+
+func addRevokedTokens(raw map[string]any) error {
+	rawCollection(raw, "revoked_tokens")
+	return nil
+}
+
+func addOneTimeTokens(raw map[string]any) error {
+	rawCollection(raw, "one_time_tokens")
+	return nil
+}
+
+// addEmailVerified leaves existing addresses unverified, since nothing ever
+// checked them.
+func addEmailVerified(raw map[string]any) error {
+	for key, value := range rawCollection(raw, "users") {
+		user, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("user %s is not an object", key)
+		}
+		user["email_verified"] = false
+	}
+	for key, value := range rawCollection(raw, "one_time_tokens") {
+		token, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("one-time token %s is not an object", key)
+		}
+		if _, ok := token["email"]; !ok {
+			token["email"] = ""
+		}
+	}
+	return nil
+}
+
+func addTOTP(raw map[string]any) error {
+	for key, value := range rawCollection(raw, "users") {
+		user, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("user %s is not an object", key)
+		}
+		user["totp_enabled"] = false
+	}
+	return nil
+}
+
+func addIdentities(raw map[string]any) error {
+	rawCollection(raw, "identities")
+	return nil
+}
+
+func addAPIKeys(raw map[string]any) error {
+	rawCollection(raw, "api_keys")
+	return nil
+}
+
+// addSessionScopes grants existing sessions every scope there is, since
+// they could do anything before.
+func addSessionScopes(raw map[string]any) error {
+	for key, value := range rawCollection(raw, "refresh_tokens") {
+		token, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("refresh token %s is not an object", key)
+		}
+		token["scopes"] = []any{"chirps:write", "account"}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// Purposes of one-time tokens.
+const (
+	PurposePasswordReset     = "password_reset"
+	PurposeEmailVerification = "email_verification"
+)
+
+// OneTimeToken is a secret mailed to a user to prove they own their email
+// address, for example to reset their password. Like refresh tokens only the
+// hash is stored. It can be used once, before it expires. Email is the
+// address it was sent to.
+type OneTimeToken struct {
+	TokenHash string     `json:"token_hash"`
+	UserID    int        `json:"user_id"`
+	Email     string     `json:"email"`
+	Purpose   string     `json:"purpose"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
+
+// CreateOneTimeToken stores token, replacing any unused token the user had
+// for the same purpose so only the most recent email works.
+func (db *DB) CreateOneTimeToken(token OneTimeToken) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[token.UserID]; !ok {
+			return fmt.Errorf("user %w", ErrNotFound)
+		}
+		if _, ok := dbStructure.OneTimeTokens[token.TokenHash]; ok {
+			return fmt.Errorf("one-time token %w", ErrAlreadyExists)
+		}
+
+		for hash, other := range dbStructure.OneTimeTokens {
+			if other.UserID == token.UserID && other.Purpose == token.Purpose && other.UsedAt == nil {
+				dbStructure.deleteOneTimeToken(hash)
+			}
+		}
+		dbStructure.putOneTimeToken(token)
+		return nil
+	})
+}
+
+// usable reports whether the token can still be used for purpose by a user
+// whose address is now currentEmail. A token sent to an address the user has
+// since replaced proves nothing about the new one.
+func (t OneTimeToken) usable(purpose string, currentEmail string, now time.Time) bool {
+	return t.Purpose == purpose && t.UsedAt == nil && !now.After(t.ExpiresAt) && t.Email == currentEmail
+}
+
+// GetOneTimeToken returns the token without using it up, so a request can be
+// checked before the token is spent. It fails like UseOneTimeToken.
+func (db *DB) GetOneTimeToken(tokenHash string, purpose string, now time.Time) (OneTimeToken, error) {
+	token := OneTimeToken{}
+	err := db.view(func(dbStructure *DBStructure) error {
+		t, ok := dbStructure.OneTimeTokens[tokenHash]
+		if !ok || !t.usable(purpose, dbStructure.Users[t.UserID].Email, now) {
+			return fmt.Errorf("one-time token %w", ErrNotFound)
+		}
+		token = t
+		return nil
+	})
+	return token, err
+}
+
+// UseOneTimeToken marks the token as used and returns it. Tokens that do not
+// exist, are for another purpose, were already used, have expired or were
+// sent to an address the user no longer has are all reported as ErrNotFound.
+func (db *DB) UseOneTimeToken(tokenHash string, purpose string, now time.Time) (OneTimeToken, error) {
+	token := OneTimeToken{}
+	err := db.update(func(dbStructure *DBStructure) error {
+		t, ok := dbStructure.OneTimeTokens[tokenHash]
+		if !ok || !t.usable(purpose, dbStructure.Users[t.UserID].Email, now) {
+			return fmt.Errorf("one-time token %w", ErrNotFound)
+		}
+
+		t.UsedAt = &now
+		dbStructure.putOneTimeToken(t)
+		token = t
+		return nil
+	})
+	return token, err
+}
+
+func (db *DB) DeleteExpiredOneTimeTokens(now time.Time) (int, error) {
+	n := 0
+	err := db.update(func(dbStructure *DBStructure) error {
+		for hash, token := range dbStructure.OneTimeTokens {
+			if now.After(token.ExpiresAt) {
+				dbStructure.deleteOneTimeToken(hash)
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,60 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testStores returns an empty store of every kind.
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	sqlDB, err := NewSQLDB(filepath.Join(t.TempDir(), "database.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	return map[string]Store{"memory": NewMemoryDB(), "sqlite": sqlDB}
+}
+
+func TestOneTimeTokenVoidAfterEmailChange(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := db.CreateUser("old@example.com", "hash")
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now().UTC()
+			err = db.CreateOneTimeToken(OneTimeToken{
+				TokenHash: HashToken("token"),
+				UserID:    user.ID,
+				Email:     user.Email,
+				Purpose:   PurposePasswordReset,
+				CreatedAt: now,
+				ExpiresAt: now.Add(time.Hour),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = db.GetOneTimeToken(HashToken("token"), PurposePasswordReset, now)
+			if err != nil {
+				t.Fatalf("before the change: %s", err)
+			}
+
+			_, err = db.UpdateUser("new@example.com", "hash", user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.GetOneTimeToken(HashToken("token"), PurposePasswordReset, now)
+			if !errors.Is(err, ErrNotFound) {
+				t.Fatalf("get after the change: got %v, want ErrNotFound", err)
+			}
+			_, err = db.UseOneTimeToken(HashToken("token"), PurposePasswordReset, now)
+			if !errors.Is(err, ErrNotFound) {
+				t.Fatalf("use after the change: got %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RefreshToken is one login session. A user can hold any number of them, one
+// per device they signed in from. ID identifies the session to its owner
+// without revealing the token.
+//
+// Only a SHA-256 of the token is kept, see HashToken, so a copy of the
+// database is not enough to sign in as anyone.
+//
+// Every refresh rotates the token: a new RefreshToken with the same ID
+// replaces it and the old one is kept with RotatedAt set, so that presenting
+// it again can be recognised as reuse, until DeleteExpiredRefreshTokens
+// removes it along with the rest of the expired session.
+type RefreshToken struct {
+	ID         string     `json:"id"`
+	TokenHash  string     `json:"token_hash"`
+	UserID     int        `json:"user_id"`
+	Device     string     `json:"device"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RotatedAt  *time.Time `json:"rotated_at,omitempty"`
+	// AccessTokenID is the jti of the last access token issued with this
+	// token, so it can be revoked along with the session.
+	AccessTokenID        string    `json:"access_token_id"`
+	AccessTokenExpiresAt time.Time `json:"access_token_expires_at"`
+	// Scopes are what the session's access tokens may be granted.
+	Scopes []string `json:"scopes"`
+}
+
+// HashToken is how refresh tokens are stored and looked up.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (db *DB) CreateRefreshToken(token RefreshToken) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[token.UserID]; !ok {
+			return fmt.Errorf("user %w", ErrNotFound)
+		}
+		if _, ok := dbStructure.RefreshTokens[token.TokenHash]; ok {
+			return fmt.Errorf("refresh token %w", ErrAlreadyExists)
+		}
+
+		dbStructure.putRefreshToken(token)
+		return nil
+	})
+}
+
+func (db *DB) GetRefreshToken(tokenHash string) (RefreshToken, error) {
+	refreshToken := RefreshToken{}
+	err := db.view(func(dbStructure *DBStructure) error {
+		t, ok := dbStructure.RefreshTokens[tokenHash]
+		if !ok {
+			return fmt.Errorf("refresh token %w", ErrNotFound)
+		}
+		refreshToken = t
+		return nil
+	})
+	return refreshToken, err
+}
+
+// RotateRefreshToken replaces the token with next, which must belong to the same
+// session. If it was already rotated it is being reused, most likely by
+// someone who stole it: the whole session is revoked and ErrTokenReused is
+// returned.
+func (db *DB) RotateRefreshToken(tokenHash string, next RefreshToken, rotatedAt time.Time) error {
+	reused := false
+	err := db.update(func(dbStructure *DBStructure) error {
+		old, ok := dbStructure.RefreshTokens[tokenHash]
+		if !ok {
+			return fmt.Errorf("refresh token %w", ErrNotFound)
+		}
+		if old.RotatedAt != nil {
+			reused = true
+			dbStructure.deleteSession(old.UserID, old.ID, rotatedAt)
+			return nil
+		}
+		if next.ID != old.ID || next.UserID != old.UserID {
+			return errors.New("rotated refresh token must stay in the same session")
+		}
+
+		old.RotatedAt = &rotatedAt
+		dbStructure.putRefreshToken(old)
+		dbStructure.putRefreshToken(next)
+		return nil
+	})
+	if err == nil && reused {
+		return ErrTokenReused
+	}
+	return err
+}
+
+// RevokeRefreshToken ends the session the token belongs to.
+func (db *DB) RevokeRefreshToken(tokenHash string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		refreshToken, ok := dbStructure.RefreshTokens[tokenHash]
+		if !ok {
+			return fmt.Errorf("refresh token %w", ErrNotFound)
+		}
+
+		dbStructure.deleteSession(refreshToken.UserID, refreshToken.ID, time.Now())
+		return nil
+	})
+}
+
+func (db *DB) GetUserRefreshTokens(userID int) ([]RefreshToken, error) {
+	tokens := []RefreshToken{}
+	err := db.view(func(dbStructure *DBStructure) error {
+		for _, token := range dbStructure.RefreshTokens {
+			if token.UserID == userID {
+				tokens = append(tokens, token)
+			}
+		}
+		return nil
+	})
+	return tokens, err
+}
+
+func (db *DB) RevokeSession(userID int, sessionID string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		if !dbStructure.deleteSession(userID, sessionID, time.Now()) {
+			return fmt.Errorf("session %w", ErrNotFound)
+		}
+		return nil
+	})
+}
+
+// RevokeUserSessions logs the user out everywhere: it deletes their sessions,
+// revokes the access tokens issued with them, and deletes their API keys,
+// which would otherwise outlive a password change made to lock out an
+// attacker.
+func (db *DB) RevokeUserSessions(userID int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		now := time.Now()
+		for _, token := range dbStructure.RefreshTokens {
+			if token.UserID == userID {
+				dbStructure.revokeAccessToken(token, now)
+				dbStructure.deleteRefreshToken(token.TokenHash)
+			}
+		}
+		for _, key := range dbStructure.APIKeys {
+			if key.UserID == userID {
+				dbStructure.deleteAPIKey(key.KeyHash)
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteExpiredRefreshTokens deletes every token past its expiry, rotated
+// ones included, and returns how many there were.
+func (db *DB) DeleteExpiredRefreshTokens(now time.Time) (int, error) {
+	n := 0
+	err := db.update(func(dbStructure *DBStructure) error {
+		for hash, token := range dbStructure.RefreshTokens {
+			if now.After(token.ExpiresAt) {
+				dbStructure.deleteRefreshToken(hash)
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+// deleteSession removes every token of the session, rotated ones included,
+// revokes the access tokens issued with them and reports whether there were
+// any.
+func (s *DBStructure) deleteSession(userID int, sessionID string, now time.Time) bool {
+	found := false
+	for _, token := range s.RefreshTokens {
+		if token.UserID == userID && token.ID == sessionID {
+			s.revokeAccessToken(token, now)
+			s.deleteRefreshToken(token.TokenHash)
+			found = true
+		}
+	}
+	return found
+}
@@ -0,0 +1,106 @@
+package database
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRevokeUserSessionsDeletesAPIKeys(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			owner, err := db.CreateUser("owner@example.com", "hash")
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := db.CreateUser("other@example.com", "hash")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, userID := range []int{owner.ID, other.ID} {
+				err = db.CreateAPIKey(APIKey{
+					ID:        fmt.Sprintf("key%d", i),
+					KeyHash:   HashToken(fmt.Sprintf("key%d", i)),
+					UserID:    userID,
+					Name:      "bot",
+					Scopes:    []string{"chirps:write"},
+					CreatedAt: time.Now().UTC(),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = db.RevokeUserSessions(owner.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keys, err := db.GetUserAPIKeys(owner.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != 0 {
+				t.Fatalf("owner has %d API keys left, want 0", len(keys))
+			}
+			keys, err = db.GetUserAPIKeys(other.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != 1 {
+				t.Fatalf("other user has %d API keys, want 1", len(keys))
+			}
+		})
+	}
+}
+
+func TestDeleteExpiredRefreshTokens(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := db.CreateUser("user@example.com", "hash")
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now().UTC()
+			session := func(id string, token string, expiresAt time.Time) RefreshToken {
+				return RefreshToken{
+					ID:         id,
+					TokenHash:  HashToken(token),
+					UserID:     user.ID,
+					CreatedAt:  now,
+					LastUsedAt: now,
+					ExpiresAt:  expiresAt,
+					Scopes:     []string{"account"},
+				}
+			}
+
+			err = db.CreateRefreshToken(session("old", "old1", now.Add(time.Hour)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.RotateRefreshToken(HashToken("old1"), session("old", "old2", now.Add(time.Hour)), now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.CreateRefreshToken(session("live", "live1", now.Add(48*time.Hour)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			n, err := db.DeleteExpiredRefreshTokens(now.Add(2 * time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 2 {
+				t.Fatalf("deleted %d tokens, want 2", n)
+			}
+			tokens, err := db.GetUserRefreshTokens(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tokens) != 1 || tokens[0].ID != "live" {
+				t.Fatalf("left %+v, want only the live session", tokens)
+			}
+		})
+	}
+}
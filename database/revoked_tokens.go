@@ -0,0 +1,50 @@
+package database
+
+import "time"
+
+// RevokedToken is an access token that must be refused even though its
+// signature and expiry are fine. It only needs to be remembered until the
+// token would have expired anyway.
+type RevokedToken struct {
+	ID        string    `json:"id"`
+	UserID    int       `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (db *DB) IsAccessTokenRevoked(tokenID string) (bool, error) {
+	revoked := false
+	err := db.view(func(dbStructure *DBStructure) error {
+		_, revoked = dbStructure.RevokedTokens[tokenID]
+		return nil
+	})
+	return revoked, err
+}
+
+// DeleteExpiredRevokedTokens forgets revoked tokens that have expired by now
+// and returns how many there were.
+func (db *DB) DeleteExpiredRevokedTokens(now time.Time) (int, error) {
+	n := 0
+	err := db.update(func(dbStructure *DBStructure) error {
+		for id, token := range dbStructure.RevokedTokens {
+			if now.After(token.ExpiresAt) {
+				dbStructure.deleteRevokedToken(id)
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+// revokeAccessToken denies the access token last issued for a session if it
+// can still be used.
+func (s *DBStructure) revokeAccessToken(token RefreshToken, now time.Time) {
+	if token.AccessTokenID == "" || now.After(token.AccessTokenExpiresAt) {
+		return
+	}
+	s.putRevokedToken(RevokedToken{
+		ID:        token.AccessTokenID,
+		UserID:    token.UserID,
+		ExpiresAt: token.AccessTokenExpiresAt,
+	})
+}
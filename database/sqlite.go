@@ -0,0 +1,475 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLDB is a Store backed by SQLite through the pure-Go modernc.org/sqlite
+// driver, so it builds without cgo.
+type SQLDB struct {
+	db *sql.DB
+}
+
+var _ Store = (*SQLDB)(nil)
+
+// sqlMigrations are applied in order; PRAGMA user_version records how many
+// have already run against a given file.
+var sqlMigrations = []func(tx *sql.Tx) error{
+	sqlExec(`CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email TEXT NOT NULL,
+		password TEXT NOT NULL,
+		is_chirpy_red INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE UNIQUE INDEX users_email_idx ON users (email);
+
+	CREATE TABLE emails (
+		email TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE refresh_tokens (
+		token TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL UNIQUE REFERENCES users (id) ON DELETE CASCADE,
+		exp TEXT NOT NULL
+	);
+
+	CREATE TABLE chirps (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		body TEXT NOT NULL,
+		author_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE
+	);
+	CREATE INDEX chirps_author_id_idx ON chirps (author_id);`),
+
+	sqlExec(`ALTER TABLE refresh_tokens RENAME TO refresh_tokens_v1;
+	CREATE TABLE refresh_tokens (
+		token TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		device TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL
+	);
+	CREATE INDEX refresh_tokens_user_id_idx ON refresh_tokens (user_id);
+	INSERT INTO refresh_tokens (token, user_id, created_at, last_used_at, expires_at)
+		SELECT token, user_id, datetime(exp, '-1440 hours'), datetime(exp, '-1440 hours'), datetime(exp)
+		FROM refresh_tokens_v1;
+	DROP TABLE refresh_tokens_v1;`),
+
+	sqlExec(`ALTER TABLE refresh_tokens ADD COLUMN id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE refresh_tokens ADD COLUMN ip TEXT NOT NULL DEFAULT '';
+	UPDATE refresh_tokens SET id = lower(hex(randomblob(16)));
+	CREATE INDEX refresh_tokens_id_idx ON refresh_tokens (id);`),
+
+	sqlExec(`ALTER TABLE refresh_tokens ADD COLUMN rotated_at DATETIME;`),
+
+	hashSQLRefreshTokens,
+
+	sqlExec(`ALTER TABLE refresh_tokens ADD COLUMN access_token_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE refresh_tokens ADD COLUMN access_token_expires_at DATETIME;
+	CREATE TABLE revoked_tokens (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		expires_at DATETIME NOT NULL
+	);
+	CREATE INDEX revoked_tokens_expires_at_idx ON revoked_tokens (expires_at);`),
+
+	sqlExec(`CREATE TABLE one_time_tokens (
+		token_hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		purpose TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		used_at DATETIME
+	);
+	CREATE INDEX one_time_tokens_user_id_idx ON one_time_tokens (user_id);`),
+
+	sqlExec(`ALTER TABLE users ADD COLUMN email_verified INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE one_time_tokens ADD COLUMN email TEXT NOT NULL DEFAULT '';`),
+
+	// recovery_codes holds the space-separated hashes of the unused codes.
+	sqlExec(`ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN totp_enabled INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN recovery_codes TEXT NOT NULL DEFAULT '';`),
+
+	sqlExec(`ALTER TABLE users ADD COLUMN failed_logins INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN locked_until DATETIME;`),
+
+	sqlExec(`CREATE TABLE identities (
+		provider TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		email TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (provider, subject)
+	);
+	CREATE INDEX identities_user_id_idx ON identities (user_id);`),
+
+	sqlExec(`CREATE TABLE api_keys (
+		key_hash TEXT PRIMARY KEY,
+		id TEXT NOT NULL UNIQUE,
+		user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME,
+		last_used_at DATETIME
+	);
+	CREATE INDEX api_keys_user_id_idx ON api_keys (user_id);`),
+
+	// Sessions from before scopes could do anything.
+	sqlExec(`ALTER TABLE refresh_tokens ADD COLUMN scopes TEXT NOT NULL DEFAULT '';
+	UPDATE refresh_tokens SET scopes = 'chirps:write account';`),
+
+	sqlExec(`ALTER TABLE users ADD COLUMN last_failed_login DATETIME;`),
+}
+
+func sqlExec(stmt string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(stmt)
+		return err
+	}
+}
+
+// hashSQLRefreshTokens is done in Go because SQLite has no SHA-256.
+func hashSQLRefreshTokens(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE refresh_tokens RENAME COLUMN token TO token_hash`)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT token_hash FROM refresh_tokens`)
+	if err != nil {
+		return err
+	}
+	tokens := []string{}
+	for rows.Next() {
+		var token string
+		err := rows.Scan(&token)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		tokens = append(tokens, token)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	for _, token := range tokens {
+		_, err := tx.Exec(`UPDATE refresh_tokens SET token_hash = ? WHERE token_hash = ?`, HashToken(token), token)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewSQLDB opens the database at path. Transactions take the write lock when
+// they begin: most read before they write, and a deferred transaction that
+// tries to upgrade its lock while another one writes fails with SQLITE_BUSY
+// at once instead of waiting out the busy timeout.
+func NewSQLDB(path string) (*SQLDB, error) {
+	dsn := "file:" + path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_time_format=sqlite&_txlock=immediate"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	sqlDB := &SQLDB{db: db}
+	err = sqlDB.migrate()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return sqlDB, nil
+}
+
+func (s *SQLDB) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLDB) migrate() error {
+	var version int
+	err := s.db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqlMigrations); i++ {
+		err := s.withTx(func(tx *sql.Tx) error {
+			err := sqlMigrations[i](tx)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("sqlite migration %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (s *SQLDB) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+const userColumns = `u.id, u.email, u.email_verified, u.password, u.is_chirpy_red, u.totp_secret, u.totp_enabled, u.totp_last_step, u.recovery_codes, u.failed_logins, u.last_failed_login, u.locked_until`
+
+const userFrom = ` FROM users u`
+
+func scanUser(row scanner) (User, error) {
+	user := User{}
+	var recoveryCodes string
+	lastFailedLogin := sql.NullTime{}
+	lockedUntil := sql.NullTime{}
+	err := row.Scan(&user.ID, &user.Email, &user.EmailVerified, &user.Password, &user.IsChirpyRed,
+		&user.TOTPSecret, &user.TOTPEnabled, &user.TOTPLastStep, &recoveryCodes, &user.FailedLogins, &lastFailedLogin, &lockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, fmt.Errorf("user %w", ErrNotFound)
+	}
+	if err != nil {
+		return User{}, err
+	}
+	user.RecoveryCodes = strings.Fields(recoveryCodes)
+	if lastFailedLogin.Valid {
+		user.LastFailedLogin = &lastFailedLogin.Time
+	}
+	if lockedUntil.Valid {
+		user.LockedUntil = &lockedUntil.Time
+	}
+	return user, nil
+}
+
+func (s *SQLDB) CreateUser(email string, passwordHash string) (UserResponse, error) {
+	var id int64
+	err := s.withTx(func(tx *sql.Tx) error {
+		err := emailAvailable(tx, email)
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.Exec(`INSERT INTO users (email, password) VALUES (?, ?)`, email, passwordHash)
+		if err != nil {
+			return err
+		}
+		id, err = res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT INTO emails (email, user_id) VALUES (?, ?)`, email, id)
+		return err
+	})
+	if err != nil {
+		return UserResponse{}, err
+	}
+
+	return UserResponse{Email: email, ID: int(id), IsChirpyRed: false}, nil
+}
+
+func emailAvailable(tx *sql.Tx, email string) error {
+	var userID int
+	err := tx.QueryRow(`SELECT user_id FROM emails WHERE email = ?`, email).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("email %w", ErrAlreadyExists)
+}
+
+func (s *SQLDB) UpdateUser(updatedEmail string, passwordHash string, id int) (UserResponse, error) {
+	var user User
+	err := s.withTx(func(tx *sql.Tx) error {
+		var err error
+		user, err = scanUser(tx.QueryRow(`SELECT `+userColumns+userFrom+` WHERE u.id = ?`, id))
+		if err != nil {
+			return err
+		}
+
+		// A new address has to be verified again.
+		if updatedEmail != user.Email {
+			err = emailAvailable(tx, updatedEmail)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(`DELETE FROM emails WHERE email = ?`, user.Email)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`INSERT INTO emails (email, user_id) VALUES (?, ?)`, updatedEmail, id)
+			if err != nil {
+				return err
+			}
+			user.Email = updatedEmail
+			user.EmailVerified = false
+		}
+
+		_, err = tx.Exec(`UPDATE users SET email = ?, email_verified = ?, password = ? WHERE id = ?`, user.Email, user.EmailVerified, passwordHash, id)
+		return err
+	})
+	if err != nil {
+		return UserResponse{}, err
+	}
+
+	return UserResponse{Email: user.Email, ID: id, EmailVerified: user.EmailVerified, IsChirpyRed: user.IsChirpyRed}, nil
+}
+
+func (s *SQLDB) GetUser(id int) (User, error) {
+	return scanUser(s.db.QueryRow(`SELECT `+userColumns+userFrom+` WHERE u.id = ?`, id))
+}
+
+func (s *SQLDB) GetUserByEmail(email string) (User, error) {
+	user, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+userFrom+` JOIN emails e ON e.user_id = u.id WHERE e.email = ?`, email))
+	if errors.Is(err, ErrNotFound) {
+		return User{}, fmt.Errorf("email %w", ErrNotFound)
+	}
+	return user, err
+}
+
+func (s *SQLDB) GetUsers() ([]User, error) {
+	rows, err := s.db.Query(`SELECT ` + userColumns + userFrom + ` ORDER BY u.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *SQLDB) UpdateUserPassword(id int, passwordHash string) error {
+	res, err := s.db.Exec(`UPDATE users SET password = ? WHERE id = ?`, passwordHash, id)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res, "user")
+}
+
+func (s *SQLDB) ReplacePasswordHash(id int, oldHash string, newHash string) error {
+	res, err := s.db.Exec(`UPDATE users SET password = ? WHERE id = ? AND password = ?`, newHash, id, oldHash)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res, "user with that password hash")
+}
+
+func (s *SQLDB) SetEmailVerified(id int, email string) error {
+	res, err := s.db.Exec(`UPDATE users SET email_verified = 1 WHERE id = ? AND email = ?`, id, email)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res, "user with email")
+}
+
+func (s *SQLDB) UpdateUserSubscription(userId int) error {
+	res, err := s.db.Exec(`UPDATE users SET is_chirpy_red = 1 WHERE id = ?`, userId)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res, "user")
+}
+
+func expectAffected(res sql.Result, entity string) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%s %w", entity, ErrNotFound)
+	}
+	return nil
+}
+
+func (s *SQLDB) CreateChirp(body string, authorID int) (Chirp, error) {
+	res, err := s.db.Exec(`INSERT INTO chirps (body, author_id) VALUES (?, ?)`, body, authorID)
+	if err != nil {
+		return Chirp{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return Chirp{ID: int(id), Body: body, AuthorID: authorID}, nil
+}
+
+func (s *SQLDB) GetChirp(id int) (Chirp, error) {
+	chirp := Chirp{}
+	err := s.db.QueryRow(`SELECT id, body, author_id FROM chirps WHERE id = ?`, id).Scan(&chirp.ID, &chirp.Body, &chirp.AuthorID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, fmt.Errorf("chirp %w", ErrNotFound)
+	}
+	return chirp, err
+}
+
+func (s *SQLDB) GetChirps() ([]Chirp, error) {
+	rows, err := s.db.Query(`SELECT id, body, author_id FROM chirps ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chirps := []Chirp{}
+	for rows.Next() {
+		chirp := Chirp{}
+		err := rows.Scan(&chirp.ID, &chirp.Body, &chirp.AuthorID)
+		if err != nil {
+			return nil, err
+		}
+		chirps = append(chirps, chirp)
+	}
+	return chirps, rows.Err()
+}
+
+func (s *SQLDB) DeleteChirp(id int, chirpId int) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		var authorID int
+		err := tx.QueryRow(`SELECT author_id FROM chirps WHERE id = ?`, chirpId).Scan(&authorID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("chirp %w", ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		if authorID != id {
+			return ErrForbidden
+		}
+
+		_, err = tx.Exec(`DELETE FROM chirps WHERE id = ?`, chirpId)
+		return err
+	})
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Scopes are stored space-separated, as in OAuth.
+const apiKeyColumns = `id, key_hash, user_id, name, scopes, created_at, expires_at, last_used_at`
+
+func scanAPIKey(row scanner) (APIKey, error) {
+	key := APIKey{}
+	var scopes string
+	expiresAt := sql.NullTime{}
+	lastUsedAt := sql.NullTime{}
+	err := row.Scan(&key.ID, &key.KeyHash, &key.UserID, &key.Name, &scopes, &key.CreatedAt, &expiresAt, &lastUsedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, fmt.Errorf("api key %w", ErrNotFound)
+	}
+	key.Scopes = strings.Fields(scopes)
+	if expiresAt.Valid {
+		key.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		key.LastUsedAt = &lastUsedAt.Time
+	}
+	return key, err
+}
+
+func insertAPIKey(db execer, key APIKey) error {
+	expiresAt := sql.NullTime{}
+	if key.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: key.ExpiresAt.UTC(), Valid: true}
+	}
+	lastUsedAt := sql.NullTime{}
+	if key.LastUsedAt != nil {
+		lastUsedAt = sql.NullTime{Time: key.LastUsedAt.UTC(), Valid: true}
+	}
+	_, err := db.Exec(`INSERT INTO api_keys (`+apiKeyColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		key.ID, key.KeyHash, key.UserID, key.Name, strings.Join(key.Scopes, " "), key.CreatedAt.UTC(), expiresAt, lastUsedAt)
+	return err
+}
+
+func (s *SQLDB) CreateAPIKey(key APIKey) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		_, err := scanUser(tx.QueryRow(`SELECT `+userColumns+userFrom+` WHERE u.id = ?`, key.UserID))
+		if err != nil {
+			return err
+		}
+
+		_, err = scanAPIKey(tx.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = ?`, key.KeyHash))
+		if err == nil {
+			return fmt.Errorf("api key %w", ErrAlreadyExists)
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		return insertAPIKey(tx, key)
+	})
+}
+
+func (s *SQLDB) GetAPIKey(keyHash string) (APIKey, error) {
+	return scanAPIKey(s.db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = ?`, keyHash))
+}
+
+func (s *SQLDB) GetUserAPIKeys(userID int) ([]APIKey, error) {
+	rows, err := s.db.Query(`SELECT `+apiKeyColumns+` FROM api_keys WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLDB) TouchAPIKey(keyHash string, usedAt time.Time) error {
+	res, err := s.db.Exec(`UPDATE api_keys SET last_used_at = ? WHERE key_hash = ?`, usedAt.UTC(), keyHash)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res, "api key")
+}
+
+func (s *SQLDB) DeleteAPIKey(userID int, id string) error {
+	res, err := s.db.Exec(`DELETE FROM api_keys WHERE user_id = ? AND id = ?`, userID, id)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res, "api key")
+}
@@ -0,0 +1,263 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+func (s *SQLDB) Backup(w io.Writer) error {
+	dbStructure := DBStructure{
+		SchemaVersion: currentSchemaVersion(),
+	}
+	dbStructure.initMaps()
+
+	// A read transaction sees one consistent state of the database even while
+	// writes carry on.
+	err := s.withTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT ` + userColumns + userFrom)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			user, err := scanUser(rows)
+			if err != nil {
+				return err
+			}
+			dbStructure.Users[user.ID] = user
+		}
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		rows, err = tx.Query(`SELECT email, user_id FROM emails`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var email string
+			var userID int
+			err := rows.Scan(&email, &userID)
+			if err != nil {
+				return err
+			}
+			dbStructure.Emails[email] = userID
+		}
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		rows, err = tx.Query(`SELECT ` + refreshTokenColumns + ` FROM refresh_tokens`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			token, err := scanRefreshToken(rows)
+			if err != nil {
+				return err
+			}
+			dbStructure.RefreshTokens[token.TokenHash] = token
+		}
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		rows, err = tx.Query(`SELECT id, user_id, expires_at FROM revoked_tokens`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			token := RevokedToken{}
+			err := rows.Scan(&token.ID, &token.UserID, &token.ExpiresAt)
+			if err != nil {
+				return err
+			}
+			dbStructure.RevokedTokens[token.ID] = token
+		}
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		rows, err = tx.Query(`SELECT ` + oneTimeTokenColumns + ` FROM one_time_tokens`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			token, err := scanOneTimeToken(rows)
+			if err != nil {
+				return err
+			}
+			dbStructure.OneTimeTokens[token.TokenHash] = token
+		}
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		rows, err = tx.Query(`SELECT ` + identityColumns + ` FROM identities`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			identity, err := scanIdentity(rows)
+			if err != nil {
+				return err
+			}
+			dbStructure.Identities[identityKey(identity.Provider, identity.Subject)] = identity
+		}
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		rows, err = tx.Query(`SELECT ` + apiKeyColumns + ` FROM api_keys`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			key, err := scanAPIKey(rows)
+			if err != nil {
+				return err
+			}
+			dbStructure.APIKeys[key.KeyHash] = key
+		}
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		rows, err = tx.Query(`SELECT id, body, author_id FROM chirps`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			chirp := Chirp{}
+			err := rows.Scan(&chirp.ID, &chirp.Body, &chirp.AuthorID)
+			if err != nil {
+				return err
+			}
+			dbStructure.Chirps[chirp.ID] = chirp
+		}
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		rows, err = tx.Query(`SELECT name, seq FROM sqlite_sequence`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			var seq int
+			err := rows.Scan(&name, &seq)
+			if err != nil {
+				return err
+			}
+			dbStructure.Sequences[name] = seq
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(dbStructure)
+}
+
+func (s *SQLDB) Restore(r io.Reader) error {
+	dbStructure, err := readBackup(r)
+	if err != nil {
+		return err
+	}
+
+	return s.withTx(func(tx *sql.Tx) error {
+		for _, table := range []string{"api_keys", "identities", "one_time_tokens", "revoked_tokens", "refresh_tokens", "chirps", "emails", "users", "sqlite_sequence"} {
+			_, err := tx.Exec(`DELETE FROM ` + table)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, user := range dbStructure.Users {
+			lastFailedLogin := sql.NullTime{}
+			if user.LastFailedLogin != nil {
+				lastFailedLogin = sql.NullTime{Time: user.LastFailedLogin.UTC(), Valid: true}
+			}
+			lockedUntil := sql.NullTime{}
+			if user.LockedUntil != nil {
+				lockedUntil = sql.NullTime{Time: user.LockedUntil.UTC(), Valid: true}
+			}
+			_, err := tx.Exec(`INSERT INTO users (id, email, email_verified, password, is_chirpy_red, totp_secret, totp_enabled, totp_last_step, recovery_codes, failed_logins, last_failed_login, locked_until)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				user.ID, user.Email, user.EmailVerified, user.Password, user.IsChirpyRed,
+				user.TOTPSecret, user.TOTPEnabled, user.TOTPLastStep, strings.Join(user.RecoveryCodes, " "),
+				user.FailedLogins, lastFailedLogin, lockedUntil)
+			if err != nil {
+				return err
+			}
+		}
+		for _, token := range dbStructure.RefreshTokens {
+			_, err := insertRefreshToken(tx, token)
+			if err != nil {
+				return err
+			}
+		}
+		for _, token := range dbStructure.RevokedTokens {
+			_, err := tx.Exec(`INSERT INTO revoked_tokens (id, user_id, expires_at) VALUES (?, ?, ?)`, token.ID, token.UserID, token.ExpiresAt.UTC())
+			if err != nil {
+				return err
+			}
+		}
+		for _, identity := range dbStructure.Identities {
+			err := insertIdentity(tx, identity)
+			if err != nil {
+				return err
+			}
+		}
+		for _, key := range dbStructure.APIKeys {
+			err := insertAPIKey(tx, key)
+			if err != nil {
+				return err
+			}
+		}
+		for _, token := range dbStructure.OneTimeTokens {
+			err := insertOneTimeToken(tx, token)
+			if err != nil {
+				return err
+			}
+		}
+		for email, userID := range dbStructure.Emails {
+			_, err := tx.Exec(`INSERT INTO emails (email, user_id) VALUES (?, ?)`, email, userID)
+			if err != nil {
+				return err
+			}
+		}
+		for _, chirp := range dbStructure.Chirps {
+			_, err := tx.Exec(`INSERT INTO chirps (id, body, author_id) VALUES (?, ?, ?)`, chirp.ID, chirp.Body, chirp.AuthorID)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Inserting explicit IDs already moved sqlite_sequence to the highest
+		// ID; set it to the backup's counters so deleted IDs stay retired.
+		_, err := tx.Exec(`DELETE FROM sqlite_sequence`)
+		if err != nil {
+			return err
+		}
+		for name, seq := range dbStructure.Sequences {
+			_, err := tx.Exec(`INSERT INTO sqlite_sequence (name, seq) VALUES (?, ?)`, name, seq)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
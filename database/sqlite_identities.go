@@ -0,0 +1,47 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+const identityColumns = `provider, subject, user_id, email, created_at`
+
+func scanIdentity(row scanner) (Identity, error) {
+	identity := Identity{}
+	err := row.Scan(&identity.Provider, &identity.Subject, &identity.UserID, &identity.Email, &identity.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Identity{}, fmt.Errorf("identity %w", ErrNotFound)
+	}
+	return identity, err
+}
+
+func insertIdentity(db execer, identity Identity) error {
+	_, err := db.Exec(`INSERT INTO identities (`+identityColumns+`) VALUES (?, ?, ?, ?, ?)`,
+		identity.Provider, identity.Subject, identity.UserID, identity.Email, identity.CreatedAt.UTC())
+	return err
+}
+
+func (s *SQLDB) CreateIdentity(identity Identity) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		_, err := scanUser(tx.QueryRow(`SELECT `+userColumns+userFrom+` WHERE u.id = ?`, identity.UserID))
+		if err != nil {
+			return err
+		}
+
+		_, err = scanIdentity(tx.QueryRow(`SELECT `+identityColumns+` FROM identities WHERE provider = ? AND subject = ?`, identity.Provider, identity.Subject))
+		if err == nil {
+			return fmt.Errorf("identity %w", ErrAlreadyExists)
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		return insertIdentity(tx, identity)
+	})
+}
+
+func (s *SQLDB) GetIdentity(provider string, subject string) (Identity, error) {
+	return scanIdentity(s.db.QueryRow(`SELECT `+identityColumns+` FROM identities WHERE provider = ? AND subject = ?`, provider, subject))
+}
@@ -0,0 +1,46 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+func (s *SQLDB) RecordFailedLogin(id int, now time.Time, window time.Duration) (int, error) {
+	failures := 0
+	err := s.withTx(func(tx *sql.Tx) error {
+		lastFailedLogin := sql.NullTime{}
+		err := tx.QueryRow(`SELECT failed_logins, last_failed_login FROM users WHERE id = ?`, id).Scan(&failures, &lastFailedLogin)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("user %w", ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+
+		if !lastFailedLogin.Valid || now.Sub(lastFailedLogin.Time) > window {
+			failures = 0
+		}
+		failures++
+		_, err = tx.Exec(`UPDATE users SET failed_logins = ?, last_failed_login = ? WHERE id = ?`, failures, now.UTC(), id)
+		return err
+	})
+	return failures, err
+}
+
+func (s *SQLDB) LockUser(id int, until time.Time) error {
+	res, err := s.db.Exec(`UPDATE users SET locked_until = ? WHERE id = ?`, until.UTC(), id)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res, "user")
+}
+
+func (s *SQLDB) UnlockUser(id int) error {
+	res, err := s.db.Exec(`UPDATE users SET failed_logins = 0, last_failed_login = NULL, locked_until = NULL WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res, "user")
+}
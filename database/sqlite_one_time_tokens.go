@@ -0,0 +1,93 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const oneTimeTokenColumns = `token_hash, user_id, email, purpose, created_at, expires_at, used_at`
+
+func scanOneTimeToken(row scanner) (OneTimeToken, error) {
+	token := OneTimeToken{}
+	usedAt := sql.NullTime{}
+	err := row.Scan(&token.TokenHash, &token.UserID, &token.Email, &token.Purpose, &token.CreatedAt, &token.ExpiresAt, &usedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return OneTimeToken{}, fmt.Errorf("one-time token %w", ErrNotFound)
+	}
+	if usedAt.Valid {
+		token.UsedAt = &usedAt.Time
+	}
+	return token, err
+}
+
+func insertOneTimeToken(db execer, token OneTimeToken) error {
+	usedAt := sql.NullTime{}
+	if token.UsedAt != nil {
+		usedAt = sql.NullTime{Time: token.UsedAt.UTC(), Valid: true}
+	}
+	_, err := db.Exec(`INSERT INTO one_time_tokens (`+oneTimeTokenColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		token.TokenHash, token.UserID, token.Email, token.Purpose, token.CreatedAt.UTC(), token.ExpiresAt.UTC(), usedAt)
+	return err
+}
+
+func (s *SQLDB) CreateOneTimeToken(token OneTimeToken) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM one_time_tokens WHERE user_id = ? AND purpose = ? AND used_at IS NULL`, token.UserID, token.Purpose)
+		if err != nil {
+			return err
+		}
+		return insertOneTimeToken(tx, token)
+	})
+}
+
+// getUsableOneTimeToken returns the token if it can still be used for
+// purpose; see OneTimeToken.usable.
+func getUsableOneTimeToken(q queryer, tokenHash string, purpose string, now time.Time) (OneTimeToken, error) {
+	token, err := scanOneTimeToken(q.QueryRow(`SELECT `+oneTimeTokenColumns+` FROM one_time_tokens WHERE token_hash = ?`, tokenHash))
+	if err != nil {
+		return OneTimeToken{}, err
+	}
+	currentEmail := ""
+	err = q.QueryRow(`SELECT email FROM users WHERE id = ?`, token.UserID).Scan(&currentEmail)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return OneTimeToken{}, err
+	}
+	if !token.usable(purpose, currentEmail, now) {
+		return OneTimeToken{}, fmt.Errorf("one-time token %w", ErrNotFound)
+	}
+	return token, nil
+}
+
+func (s *SQLDB) GetOneTimeToken(tokenHash string, purpose string, now time.Time) (OneTimeToken, error) {
+	return getUsableOneTimeToken(s.db, tokenHash, purpose, now)
+}
+
+func (s *SQLDB) UseOneTimeToken(tokenHash string, purpose string, now time.Time) (OneTimeToken, error) {
+	var token OneTimeToken
+	err := s.withTx(func(tx *sql.Tx) error {
+		var err error
+		token, err = getUsableOneTimeToken(tx, tokenHash, purpose, now)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE one_time_tokens SET used_at = ? WHERE token_hash = ?`, now.UTC(), tokenHash)
+		token.UsedAt = &now
+		return err
+	})
+	if err != nil {
+		return OneTimeToken{}, err
+	}
+	return token, nil
+}
+
+func (s *SQLDB) DeleteExpiredOneTimeTokens(now time.Time) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM one_time_tokens WHERE expires_at < ?`, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
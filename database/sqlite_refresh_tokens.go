@@ -0,0 +1,180 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const refreshTokenColumns = `id, token_hash, user_id, device, ip, created_at, last_used_at, expires_at, rotated_at, access_token_id, access_token_expires_at, scopes`
+
+func scanRefreshToken(row scanner) (RefreshToken, error) {
+	token := RefreshToken{}
+	rotatedAt := sql.NullTime{}
+	accessTokenExpiresAt := sql.NullTime{}
+	var scopes string
+	err := row.Scan(&token.ID, &token.TokenHash, &token.UserID, &token.Device, &token.IP, &token.CreatedAt, &token.LastUsedAt, &token.ExpiresAt, &rotatedAt,
+		&token.AccessTokenID, &accessTokenExpiresAt, &scopes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RefreshToken{}, fmt.Errorf("refresh token %w", ErrNotFound)
+	}
+	if rotatedAt.Valid {
+		token.RotatedAt = &rotatedAt.Time
+	}
+	token.AccessTokenExpiresAt = accessTokenExpiresAt.Time
+	token.Scopes = strings.Fields(scopes)
+	return token, err
+}
+
+func (s *SQLDB) CreateRefreshToken(token RefreshToken) error {
+	_, err := insertRefreshToken(s.db, token)
+	return err
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+type queryer interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func insertRefreshToken(db execer, token RefreshToken) (sql.Result, error) {
+	rotatedAt := sql.NullTime{}
+	if token.RotatedAt != nil {
+		rotatedAt = sql.NullTime{Time: token.RotatedAt.UTC(), Valid: true}
+	}
+	return db.Exec(`INSERT INTO refresh_tokens (`+refreshTokenColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		token.ID, token.TokenHash, token.UserID, token.Device, token.IP, token.CreatedAt.UTC(), token.LastUsedAt.UTC(), token.ExpiresAt.UTC(), rotatedAt,
+		token.AccessTokenID, token.AccessTokenExpiresAt.UTC(), strings.Join(token.Scopes, " "))
+}
+
+func (s *SQLDB) GetRefreshToken(tokenHash string) (RefreshToken, error) {
+	return scanRefreshToken(s.db.QueryRow(`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE token_hash = ?`, tokenHash))
+}
+
+func (s *SQLDB) RotateRefreshToken(tokenHash string, next RefreshToken, rotatedAt time.Time) error {
+	reused := false
+	err := s.withTx(func(tx *sql.Tx) error {
+		old, err := scanRefreshToken(tx.QueryRow(`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE token_hash = ?`, tokenHash))
+		if err != nil {
+			return err
+		}
+		if old.RotatedAt != nil {
+			reused = true
+			return deleteRefreshTokens(tx, `user_id = ? AND id = ?`, old.UserID, old.ID)
+		}
+		if next.ID != old.ID || next.UserID != old.UserID {
+			return errors.New("rotated refresh token must stay in the same session")
+		}
+
+		_, err = tx.Exec(`UPDATE refresh_tokens SET rotated_at = ? WHERE token_hash = ?`, rotatedAt.UTC(), tokenHash)
+		if err != nil {
+			return err
+		}
+		_, err = insertRefreshToken(tx, next)
+		return err
+	})
+	if err == nil && reused {
+		return ErrTokenReused
+	}
+	return err
+}
+
+// RevokeRefreshToken ends the session the token belongs to.
+func (s *SQLDB) RevokeRefreshToken(tokenHash string) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		var userID int
+		var sessionID string
+		err := tx.QueryRow(`SELECT user_id, id FROM refresh_tokens WHERE token_hash = ?`, tokenHash).Scan(&userID, &sessionID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("refresh token %w", ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		return deleteRefreshTokens(tx, `user_id = ? AND id = ?`, userID, sessionID)
+	})
+}
+
+func (s *SQLDB) GetUserRefreshTokens(userID int) ([]RefreshToken, error) {
+	rows, err := s.db.Query(`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE user_id = ? ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []RefreshToken{}
+	for rows.Next() {
+		token, err := scanRefreshToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *SQLDB) RevokeSession(userID int, sessionID string) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		var n int
+		err := tx.QueryRow(`SELECT count(*) FROM refresh_tokens WHERE user_id = ? AND id = ?`, userID, sessionID).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("session %w", ErrNotFound)
+		}
+		return deleteRefreshTokens(tx, `user_id = ? AND id = ?`, userID, sessionID)
+	})
+}
+
+func (s *SQLDB) RevokeUserSessions(userID int) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM api_keys WHERE user_id = ?`, userID)
+		if err != nil {
+			return err
+		}
+		return deleteRefreshTokens(tx, `user_id = ?`, userID)
+	})
+}
+
+func (s *SQLDB) DeleteExpiredRefreshTokens(now time.Time) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM refresh_tokens WHERE expires_at < ?`, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// deleteRefreshTokens deletes the refresh tokens matching where after adding
+// the access tokens issued with them to the denylist.
+func deleteRefreshTokens(tx *sql.Tx, where string, args ...any) error {
+	_, err := tx.Exec(`INSERT OR IGNORE INTO revoked_tokens (id, user_id, expires_at)
+		SELECT access_token_id, user_id, access_token_expires_at FROM refresh_tokens
+		WHERE access_token_id != '' AND access_token_expires_at > ? AND `+where,
+		append([]any{time.Now().UTC()}, args...)...)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM refresh_tokens WHERE `+where, args...)
+	return err
+}
+
+func (s *SQLDB) IsAccessTokenRevoked(tokenID string) (bool, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT count(*) FROM revoked_tokens WHERE id = ?`, tokenID).Scan(&n)
+	return n > 0, err
+}
+
+func (s *SQLDB) DeleteExpiredRevokedTokens(now time.Time) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM revoked_tokens WHERE expires_at < ?`, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSQLDBConcurrentWrites(t *testing.T) {
+	db, err := NewSQLDB(filepath.Join(t.TempDir(), "database.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// CreateUser and UpdateUser read before they write.
+			user, err := db.CreateUser(fmt.Sprintf("user%d@example.com", i), "hash")
+			if err != nil {
+				errs <- fmt.Errorf("create user %d: %w", i, err)
+				return
+			}
+			_, err = db.UpdateUser(fmt.Sprintf("renamed%d@example.com", i), "hash", user.ID)
+			if err != nil {
+				errs <- fmt.Errorf("update user %d: %w", i, err)
+				return
+			}
+			chirp, err := db.CreateChirp("hello", user.ID)
+			if err != nil {
+				errs <- fmt.Errorf("create chirp %d: %w", i, err)
+				return
+			}
+			err = db.DeleteChirp(user.ID, chirp.ID)
+			if err != nil {
+				errs <- fmt.Errorf("delete chirp %d: %w", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	users, err := db.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != n {
+		t.Fatalf("got %d users, want %d", len(users), n)
+	}
+	seen := map[int]bool{}
+	for _, user := range users {
+		if seen[user.ID] {
+			t.Errorf("user ID %d handed out twice", user.ID)
+		}
+		seen[user.ID] = true
+	}
+}
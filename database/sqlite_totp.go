@@ -0,0 +1,82 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+func (s *SQLDB) SetTOTPSecret(id int, secret string) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		user, err := scanUser(tx.QueryRow(`SELECT `+userColumns+userFrom+` WHERE u.id = ?`, id))
+		if err != nil {
+			return err
+		}
+		if user.TOTPEnabled {
+			return fmt.Errorf("two-factor authentication %w", ErrAlreadyExists)
+		}
+
+		_, err = tx.Exec(`UPDATE users SET totp_secret = ? WHERE id = ?`, secret, id)
+		return err
+	})
+}
+
+func (s *SQLDB) EnableTOTP(id int, step int64, recoveryCodeHashes []string) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		user, err := scanUser(tx.QueryRow(`SELECT `+userColumns+userFrom+` WHERE u.id = ?`, id))
+		if err != nil {
+			return err
+		}
+		if user.TOTPSecret == "" {
+			return fmt.Errorf("two-factor enrollment %w", ErrNotFound)
+		}
+		if user.TOTPEnabled {
+			return fmt.Errorf("two-factor authentication %w", ErrAlreadyExists)
+		}
+
+		_, err = tx.Exec(`UPDATE users SET totp_enabled = 1, totp_last_step = ?, recovery_codes = ? WHERE id = ?`,
+			step, strings.Join(recoveryCodeHashes, " "), id)
+		return err
+	})
+}
+
+func (s *SQLDB) DisableTOTP(id int) error {
+	res, err := s.db.Exec(`UPDATE users SET totp_enabled = 0, totp_secret = '', totp_last_step = 0, recovery_codes = '' WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res, "user")
+}
+
+func (s *SQLDB) UseTOTPStep(id int, step int64) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		user, err := scanUser(tx.QueryRow(`SELECT `+userColumns+userFrom+` WHERE u.id = ?`, id))
+		if err != nil {
+			return err
+		}
+		if step <= user.TOTPLastStep {
+			return ErrCodeReused
+		}
+
+		_, err = tx.Exec(`UPDATE users SET totp_last_step = ? WHERE id = ?`, step, id)
+		return err
+	})
+}
+
+func (s *SQLDB) UseRecoveryCode(id int, codeHash string) error {
+	return s.withTx(func(tx *sql.Tx) error {
+		user, err := scanUser(tx.QueryRow(`SELECT `+userColumns+userFrom+` WHERE u.id = ?`, id))
+		if err != nil {
+			return err
+		}
+
+		for i, hash := range user.RecoveryCodes {
+			if hash == codeHash {
+				remaining := append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+				_, err = tx.Exec(`UPDATE users SET recovery_codes = ? WHERE id = ?`, strings.Join(remaining, " "), id)
+				return err
+			}
+		}
+		return fmt.Errorf("recovery code %w", ErrNotFound)
+	})
+}
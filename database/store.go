@@ -0,0 +1,95 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
+	ErrForbidden     = errors.New("forbidden")
+	ErrCorrupt       = errors.New("database file is corrupt")
+	ErrTokenReused   = errors.New("refresh token reused")
+	ErrCodeReused    = errors.New("code already used")
+)
+
+// Store is the storage used by the HTTP handlers. DB implements it on top of
+// a JSON file or, via NewMemoryDB, entirely in memory; SQLDB uses SQLite.
+type Store interface {
+	CreateUser(email string, passwordHash string) (UserResponse, error)
+	UpdateUser(email string, passwordHash string, id int) (UserResponse, error)
+	GetUser(id int) (User, error)
+	GetUserByEmail(email string) (User, error)
+	GetUsers() ([]User, error)
+	UpdateUserPassword(id int, passwordHash string) error
+	ReplacePasswordHash(id int, oldHash string, newHash string) error
+	SetEmailVerified(id int, email string) error
+
+	SetTOTPSecret(id int, secret string) error
+	EnableTOTP(id int, step int64, recoveryCodeHashes []string) error
+	DisableTOTP(id int) error
+	UseTOTPStep(id int, step int64) error
+	UseRecoveryCode(id int, codeHash string) error
+	UpdateUserSubscription(userId int) error
+
+	RecordFailedLogin(id int, now time.Time, window time.Duration) (int, error)
+	LockUser(id int, until time.Time) error
+	UnlockUser(id int) error
+
+	CreateRefreshToken(token RefreshToken) error
+	GetRefreshToken(tokenHash string) (RefreshToken, error)
+	RotateRefreshToken(tokenHash string, next RefreshToken, rotatedAt time.Time) error
+	RevokeRefreshToken(tokenHash string) error
+	GetUserRefreshTokens(userID int) ([]RefreshToken, error)
+	RevokeSession(userID int, sessionID string) error
+	RevokeUserSessions(userID int) error
+	DeleteExpiredRefreshTokens(now time.Time) (int, error)
+
+	IsAccessTokenRevoked(tokenID string) (bool, error)
+	DeleteExpiredRevokedTokens(now time.Time) (int, error)
+
+	CreateOneTimeToken(token OneTimeToken) error
+	GetOneTimeToken(tokenHash string, purpose string, now time.Time) (OneTimeToken, error)
+	UseOneTimeToken(tokenHash string, purpose string, now time.Time) (OneTimeToken, error)
+	DeleteExpiredOneTimeTokens(now time.Time) (int, error)
+
+	CreateIdentity(identity Identity) error
+	GetIdentity(provider string, subject string) (Identity, error)
+
+	CreateAPIKey(key APIKey) error
+	GetAPIKey(keyHash string) (APIKey, error)
+	GetUserAPIKeys(userID int) ([]APIKey, error)
+	TouchAPIKey(keyHash string, usedAt time.Time) error
+	DeleteAPIKey(userID int, id string) error
+
+	CreateChirp(body string, authorID int) (Chirp, error)
+	GetChirp(id int) (Chirp, error)
+	GetChirps() ([]Chirp, error)
+	DeleteChirp(id int, chirpId int) error
+
+	// Backup writes a consistent JSON snapshot of the whole store; Restore
+	// validates one and replaces the store's contents with it atomically.
+	Backup(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+var _ Store = (*DB)(nil)
+
+// Open returns the Store selected by driver: "json" (the default), "sqlite"
+// or "memory". path is ignored by the memory driver and opts only apply to
+// the JSON one.
+func Open(driver string, path string, opts ...Option) (Store, error) {
+	switch driver {
+	case "", "json":
+		return NewDB(path, opts...)
+	case "sqlite":
+		return NewSQLDB(path)
+	case "memory":
+		return NewMemoryDB(), nil
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", driver)
+	}
+}
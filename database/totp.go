@@ -0,0 +1,94 @@
+package database
+
+import "fmt"
+
+// SetTOTPSecret starts two-factor enrollment. The secret only takes effect
+// once EnableTOTP confirms the user's authenticator produces matching codes.
+func (db *DB) SetTOTPSecret(id int, secret string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[id]
+		if !ok {
+			return fmt.Errorf("user %w", ErrNotFound)
+		}
+		if user.TOTPEnabled {
+			return fmt.Errorf("two-factor authentication %w", ErrAlreadyExists)
+		}
+
+		user.TOTPSecret = secret
+		dbStructure.putUser(user)
+		return nil
+	})
+}
+
+// EnableTOTP turns two-factor authentication on. step is the time step of the
+// code the user confirmed with, which can't be used again.
+func (db *DB) EnableTOTP(id int, step int64, recoveryCodeHashes []string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[id]
+		if !ok || user.TOTPSecret == "" {
+			return fmt.Errorf("two-factor enrollment %w", ErrNotFound)
+		}
+		if user.TOTPEnabled {
+			return fmt.Errorf("two-factor authentication %w", ErrAlreadyExists)
+		}
+
+		user.TOTPEnabled = true
+		user.TOTPLastStep = step
+		user.RecoveryCodes = recoveryCodeHashes
+		dbStructure.putUser(user)
+		return nil
+	})
+}
+
+func (db *DB) DisableTOTP(id int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[id]
+		if !ok {
+			return fmt.Errorf("user %w", ErrNotFound)
+		}
+
+		user.TOTPEnabled = false
+		user.TOTPSecret = ""
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+		dbStructure.putUser(user)
+		return nil
+	})
+}
+
+// UseTOTPStep records that the user authenticated with the code for step. It
+// returns ErrCodeReused for a step no later than the last one used.
+func (db *DB) UseTOTPStep(id int, step int64) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[id]
+		if !ok {
+			return fmt.Errorf("user %w", ErrNotFound)
+		}
+		if step <= user.TOTPLastStep {
+			return ErrCodeReused
+		}
+
+		user.TOTPLastStep = step
+		dbStructure.putUser(user)
+		return nil
+	})
+}
+
+// UseRecoveryCode removes the recovery code so it can't be used again.
+func (db *DB) UseRecoveryCode(id int, codeHash string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[id]
+		if !ok {
+			return fmt.Errorf("user %w", ErrNotFound)
+		}
+
+		for i, hash := range user.RecoveryCodes {
+			if hash == codeHash {
+				user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+				dbStructure.putUser(user)
+				return nil
+			}
+		}
+		return fmt.Errorf("recovery code %w", ErrNotFound)
+	})
+}
@@ -0,0 +1,229 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+// walRecord is one entry of the file backend's write-ahead log. Records hold
+// the full new value of an entity, so replaying a record twice is harmless.
+type walRecord struct {
+	Op         string          `json:"op"`
+	Collection string          `json:"collection"`
+	Key        string          `json:"key"`
+	Value      json.RawMessage `json:"value,omitempty"`
+}
+
+// walHeader is the first line of the log. Logs written before headers were
+// added start straight with a record and count as generation 0, like
+// snapshots without a generation.
+type walHeader struct {
+	Generation int `json:"generation"`
+}
+
+// parseLogHeader reads the generation from the first line of a log and
+// reports whether that line was a header rather than a record.
+func parseLogHeader(line []byte) (generation int, isHeader bool, err error) {
+	header := struct {
+		walHeader
+		Op string `json:"op"`
+	}{}
+	err = json.Unmarshal(line, &header)
+	if err != nil {
+		return 0, false, err
+	}
+	if header.Op != "" {
+		return 0, false, nil
+	}
+	return header.Generation, true, nil
+}
+
+// Mutations inside update must go through these helpers rather than writing
+// to the maps directly, otherwise they are lost from the log.
+
+func (s *DBStructure) putUser(user User) {
+	put(s, s.Users, "users", user.ID, user)
+}
+
+func (s *DBStructure) putEmail(email string, id int) {
+	put(s, s.Emails, "emails", email, id)
+}
+
+func (s *DBStructure) deleteEmail(email string) {
+	del(s, s.Emails, "emails", email)
+}
+
+func (s *DBStructure) putChirp(chirp Chirp) {
+	put(s, s.Chirps, "chirps", chirp.ID, chirp)
+}
+
+func (s *DBStructure) deleteChirp(id int) {
+	del(s, s.Chirps, "chirps", id)
+}
+
+func (s *DBStructure) putRefreshToken(token RefreshToken) {
+	put(s, s.RefreshTokens, "refresh_tokens", token.TokenHash, token)
+}
+
+func (s *DBStructure) deleteRefreshToken(tokenHash string) {
+	del(s, s.RefreshTokens, "refresh_tokens", tokenHash)
+}
+
+func (s *DBStructure) putRevokedToken(token RevokedToken) {
+	put(s, s.RevokedTokens, "revoked_tokens", token.ID, token)
+}
+
+func (s *DBStructure) deleteRevokedToken(id string) {
+	del(s, s.RevokedTokens, "revoked_tokens", id)
+}
+
+func (s *DBStructure) putOneTimeToken(token OneTimeToken) {
+	put(s, s.OneTimeTokens, "one_time_tokens", token.TokenHash, token)
+}
+
+func (s *DBStructure) deleteOneTimeToken(tokenHash string) {
+	del(s, s.OneTimeTokens, "one_time_tokens", tokenHash)
+}
+
+func (s *DBStructure) putIdentity(identity Identity) {
+	put(s, s.Identities, "identities", identityKey(identity.Provider, identity.Subject), identity)
+}
+
+func (s *DBStructure) putAPIKey(key APIKey) {
+	put(s, s.APIKeys, "api_keys", key.KeyHash, key)
+}
+
+func (s *DBStructure) deleteAPIKey(keyHash string) {
+	del(s, s.APIKeys, "api_keys", keyHash)
+}
+
+// nextID allocates the next ID for collection and records the new sequence
+// value alongside the entity that uses it.
+func (s *DBStructure) nextID(collection string) int {
+	id := s.Sequences[collection] + 1
+	put(s, s.Sequences, "sequences", collection, id)
+	return id
+}
+
+// initMaps makes sure every collection exists, including ones added after the
+// file was written, before records are applied to it.
+func (s *DBStructure) initMaps() {
+	if s.Users == nil {
+		s.Users = map[int]User{}
+	}
+	if s.Emails == nil {
+		s.Emails = map[string]int{}
+	}
+	if s.Chirps == nil {
+		s.Chirps = map[int]Chirp{}
+	}
+	if s.Sequences == nil {
+		s.Sequences = map[string]int{}
+	}
+	if s.RefreshTokens == nil {
+		s.RefreshTokens = map[string]RefreshToken{}
+	}
+	if s.RevokedTokens == nil {
+		s.RevokedTokens = map[string]RevokedToken{}
+	}
+	if s.OneTimeTokens == nil {
+		s.OneTimeTokens = map[string]OneTimeToken{}
+	}
+	if s.Identities == nil {
+		s.Identities = map[string]Identity{}
+	}
+	if s.APIKeys == nil {
+		s.APIKeys = map[string]APIKey{}
+	}
+}
+
+func (s *DBStructure) apply(r walRecord) error {
+	switch r.Collection {
+	case "users":
+		return applyRecord(s.Users, r)
+	case "emails":
+		return applyRecord(s.Emails, r)
+	case "chirps":
+		return applyRecord(s.Chirps, r)
+	case "sequences":
+		return applyRecord(s.Sequences, r)
+	case "refresh_tokens":
+		return applyRecord(s.RefreshTokens, r)
+	case "revoked_tokens":
+		return applyRecord(s.RevokedTokens, r)
+	case "one_time_tokens":
+		return applyRecord(s.OneTimeTokens, r)
+	case "identities":
+		return applyRecord(s.Identities, r)
+	case "api_keys":
+		return applyRecord(s.APIKeys, r)
+	default:
+		return fmt.Errorf("unknown collection %q", r.Collection)
+	}
+}
+
+func put[K comparable, V any](s *DBStructure, m map[K]V, collection string, key K, value V) {
+	m[key] = value
+	dat, _ := json.Marshal(value)
+	s.changes = append(s.changes, walRecord{Op: opPut, Collection: collection, Key: fmt.Sprint(key), Value: dat})
+}
+
+func del[K comparable, V any](s *DBStructure, m map[K]V, collection string, key K) {
+	delete(m, key)
+	s.changes = append(s.changes, walRecord{Op: opDelete, Collection: collection, Key: fmt.Sprint(key)})
+}
+
+func applyRecord[K comparable, V any](m map[K]V, r walRecord) error {
+	var key K
+	switch k := any(&key).(type) {
+	case *int:
+		n, err := strconv.Atoi(r.Key)
+		if err != nil {
+			return err
+		}
+		*k = n
+	case *string:
+		*k = r.Key
+	}
+
+	switch r.Op {
+	case opPut:
+		var value V
+		err := json.Unmarshal(r.Value, &value)
+		if err != nil {
+			return err
+		}
+		m[key] = value
+	case opDelete:
+		delete(m, key)
+	default:
+		return fmt.Errorf("unknown op %q", r.Op)
+	}
+	return nil
+}
+
+// applyRaw is apply for a database decoded into generic JSON values, used by
+// migrations that must see the log in the shape it was written.
+func applyRaw(raw map[string]any, r walRecord) error {
+	coll := rawCollection(raw, r.Collection)
+	switch r.Op {
+	case opPut:
+		var value any
+		err := json.Unmarshal(r.Value, &value)
+		if err != nil {
+			return err
+		}
+		coll[r.Key] = value
+	case opDelete:
+		delete(coll, r.Key)
+	default:
+		return fmt.Errorf("unknown op %q", r.Op)
+	}
+	return nil
+}
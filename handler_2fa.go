@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/creighbattle/chirpy/auth"
+	"github.com/creighbattle/chirpy/database"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	totpIssuer        = "Chirpy"
+	recoveryCodeCount = 10
+)
+
+var errInvalidSecondFactor = errors.New("Invalid two-factor code")
+
+// checkSecondFactor accepts either a current TOTP code or one of the user's
+// unused recovery codes, and makes sure neither can be used twice.
+func (cfg *apiConfig) checkSecondFactor(user database.User, code string, recoveryCode string) error {
+	if recoveryCode != "" {
+		err := cfg.DB.UseRecoveryCode(user.ID, database.HashToken(auth.NormalizeRecoveryCode(recoveryCode)))
+		if errors.Is(err, database.ErrNotFound) {
+			return errInvalidSecondFactor
+		}
+		return err
+	}
+
+	step, ok := auth.ValidateTOTP(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return errInvalidSecondFactor
+	}
+	err := cfg.DB.UseTOTPStep(user.ID, step)
+	if errors.Is(err, database.ErrCodeReused) {
+		return errInvalidSecondFactor
+	}
+	return err
+}
+
+func (cfg *apiConfig) handlerLogin2FA(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		MFAToken         string `json:"mfa_token"`
+		Code             string `json:"code"`
+		RecoveryCode     string `json:"recovery_code"`
+		ExpiresInSeconds int    `json:"expires_in_seconds"`
+		Device           string `json:"device"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	userID, scopes, err := auth.ValidateMFAChallenge(params.MFAToken, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired MFA token")
+		return
+	}
+
+	user, err := cfg.DB.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting user")
+		return
+	}
+	if !user.TOTPEnabled {
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired MFA token")
+		return
+	}
+	if cfg.loginLockedOut(w, r, &user, "") {
+		return
+	}
+
+	err = cfg.checkSecondFactor(user, params.Code, params.RecoveryCode)
+	if errors.Is(err, errInvalidSecondFactor) {
+		cfg.loginFailed(r, &user, "")
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check two-factor code")
+		return
+	}
+
+	cfg.loginSucceeded(user)
+	cfg.respondWithSession(w, r, user, params.Device, params.ExpiresInSeconds, scopes)
+}
+
+// handlerTOTPSetup starts enrollment. Two-factor authentication stays off
+// until the user proves their authenticator works with handlerTOTPConfirm.
+func (cfg *apiConfig) handlerTOTPSetup(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+		// QRCodePNG is the URI as a base64 encoded PNG.
+		QRCodePNG []byte `json:"qr_code_png"`
+	}
+
+	userID, _ := auth.UserIDFromContext(r.Context())
+	user, err := cfg.DB.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting user")
+		return
+	}
+
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	err = cfg.DB.SetTOTPSecret(user.ID, secret)
+	if errors.Is(err, database.ErrAlreadyExists) {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't start two-factor setup")
+		return
+	}
+
+	uri := auth.TOTPURI(secret, totpIssuer, user.Email)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't render QR code")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{Secret: secret, OTPAuthURI: uri, QRCodePNG: png})
+}
+
+// handlerTOTPConfirm turns two-factor authentication on and returns the
+// recovery codes. They are only ever shown this once.
+func (cfg *apiConfig) handlerTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Code string `json:"code"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	userID, _ := auth.UserIDFromContext(r.Context())
+	user, err := cfg.DB.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting user")
+		return
+	}
+	if user.TOTPEnabled {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+	if user.TOTPSecret == "" {
+		respondWithError(w, http.StatusBadRequest, "Start two-factor setup first")
+		return
+	}
+
+	step, ok := auth.ValidateTOTP(user.TOTPSecret, params.Code, time.Now())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, errInvalidSecondFactor.Error())
+		return
+	}
+
+	codes, err := auth.NewRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = database.HashToken(code)
+	}
+
+	err = cfg.DB.EnableTOTP(user.ID, step, hashes)
+	if errors.Is(err, database.ErrAlreadyExists) {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't enable two-factor authentication")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{
+		RecoveryCodes: codes,
+	})
+}
+
+// handlerTOTPDisable needs the password and a second factor, so a stolen
+// access token alone can't remove two-factor authentication.
+func (cfg *apiConfig) handlerTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	userID, _ := auth.UserIDFromContext(r.Context())
+	user, err := cfg.DB.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting user")
+		return
+	}
+	if !user.TOTPEnabled {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is not enabled")
+		return
+	}
+
+	// Wrong guesses count as failed logins, or this would be a way around
+	// the login lockout.
+	if cfg.loginLockedOut(w, r, &user, "") {
+		return
+	}
+	if !cfg.checkPassword(&user, params.Password) {
+		cfg.loginFailed(r, &user, "")
+		respondWithError(w, http.StatusUnauthorized, "Passwords do not match")
+		return
+	}
+	err = cfg.checkSecondFactor(user, params.Code, params.RecoveryCode)
+	if errors.Is(err, errInvalidSecondFactor) {
+		cfg.loginFailed(r, &user, "")
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check two-factor code")
+		return
+	}
+
+	err = cfg.DB.DisableTOTP(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't disable two-factor authentication")
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, struct{}{})
+}
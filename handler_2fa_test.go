@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/creighbattle/chirpy/auth"
+	"github.com/creighbattle/chirpy/database"
+)
+
+func TestTOTPDisableCountsFailedLogins(t *testing.T) {
+	cfg := newTestConfig(t, database.NewMemoryDB())
+	srv := newTestServer(t, cfg)
+	user := createTestUser(t, cfg, "twofactor@example.com")
+	token := testToken(t, cfg, user.ID)
+
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.DB.SetTOTPSecret(user.ID, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.DB.EnableTOTP(user.ID, 0, []string{database.HashToken("recovery")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < accountBackoff.freeAttempts; i++ {
+		code := doRequest(t, srv, "POST", "/api/users/2fa/disable", token, map[string]string{"password": "wrong password", "recovery_code": "recovery"}, nil)
+		if code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: got %d, want %d", i+1, code, http.StatusUnauthorized)
+		}
+	}
+
+	code := doRequest(t, srv, "POST", "/api/users/2fa/disable", token, map[string]string{"password": testPassword, "recovery_code": "recovery"}, nil)
+	if code != http.StatusTooManyRequests {
+		t.Fatalf("after %d failures: got %d, want %d", accountBackoff.freeAttempts, code, http.StatusTooManyRequests)
+	}
+}
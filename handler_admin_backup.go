@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/creighbattle/chirpy/database"
+)
+
+const maxRestoreBytes = 512 << 20
+
+func (cfg *apiConfig) handlerBackup(w http.ResponseWriter, r *http.Request) {
+	if !cfg.authorizeAdmin(w, r) {
+		return
+	}
+
+	// Take the snapshot before writing any headers so a failure can still be
+	// reported as an error response.
+	buf := bytes.Buffer{}
+	err := cfg.DB.Backup(&buf)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't back up database")
+		return
+	}
+
+	filename := fmt.Sprintf("chirpy-backup-%s.json", time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+	buf.WriteTo(w)
+}
+
+func (cfg *apiConfig) handlerRestore(w http.ResponseWriter, r *http.Request) {
+	if !cfg.authorizeAdmin(w, r) {
+		return
+	}
+
+	err := cfg.DB.Restore(http.MaxBytesReader(w, r.Body, maxRestoreBytes))
+	if errors.Is(err, database.ErrInvalidBackup) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't restore database")
+		return
+	}
+
+	log.Printf("Database restored from backup")
+	respondWithJSON(w, http.StatusNoContent, struct{}{})
+}
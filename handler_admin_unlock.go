@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/creighbattle/chirpy/database"
+)
+
+// handlerUnlockUser lifts a lockout from too many failed logins before it
+// runs out.
+func (cfg *apiConfig) handlerUnlockUser(w http.ResponseWriter, r *http.Request) {
+	if !cfg.authorizeAdmin(w, r) {
+		return
+	}
+
+	userID, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	err = cfg.DB.UnlockUser(userID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't unlock user")
+		return
+	}
+
+	log.Printf("admin: unlocked user %d", userID)
+	respondWithJSON(w, http.StatusNoContent, struct{}{})
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/creighbattle/chirpy/auth"
+	"github.com/creighbattle/chirpy/database"
+)
+
+// apiKeyPrefix marks chirpy's API keys so secret scanners can recognise a
+// leaked one.
+const apiKeyPrefix = "chirpy_"
+
+// apiKeyTouchInterval limits how often using a key writes its last-used time.
+const apiKeyTouchInterval = time.Minute
+
+const maxAPIKeyNameLength = 100
+
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	// Key is only ever shown when the key is created.
+	Key string `json:"key,omitempty"`
+}
+
+func apiKeyResponse(key database.APIKey) APIKey {
+	return APIKey{
+		ID:         key.ID,
+		Name:       key.Name,
+		Scopes:     key.Scopes,
+		CreatedAt:  key.CreatedAt,
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+	}
+}
+
+func (cfg *apiConfig) handlerAPIKeysCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name             string   `json:"name"`
+		Scopes           []string `json:"scopes"`
+		ExpiresInSeconds int      `json:"expires_in_seconds"`
+	}
+	userID, _ := auth.UserIDFromContext(r.Context())
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	callerScopes := auth.ScopesFromContext(r.Context())
+
+	params.Name = strings.TrimSpace(params.Name)
+	errs := []fieldError{}
+	if params.Name == "" || utf8.RuneCountInString(params.Name) > maxAPIKeyNameLength {
+		errs = append(errs, fieldError{Field: "name", Code: "invalid", Message: "Name must be 1 to 100 characters"})
+	}
+	scopes := []string{}
+	for _, scope := range params.Scopes {
+		if !slices.Contains(auth.APIKeyScopes, scope) {
+			errs = append(errs, fieldError{Field: "scopes", Code: "invalid", Message: "API keys can't have scope " + scope})
+			continue
+		}
+		// A key can't do more than the token that created it.
+		if !slices.Contains(callerScopes, scope) {
+			errs = append(errs, fieldError{Field: "scopes", Code: "not_granted", Message: "Your token doesn't have scope " + scope})
+			continue
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(params.Scopes) == 0 {
+		errs = append(errs, fieldError{Field: "scopes", Code: "required", Message: "At least one scope is required"})
+	}
+	if params.ExpiresInSeconds < 0 {
+		errs = append(errs, fieldError{Field: "expires_in_seconds", Code: "invalid", Message: "Expiry can't be in the past"})
+	}
+	if len(errs) > 0 {
+		respondWithValidationErrors(w, errs)
+		return
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	plaintext := apiKeyPrefix + hex.EncodeToString(secret)
+
+	now := time.Now().UTC()
+	key := database.APIKey{
+		ID:        hex.EncodeToString(id),
+		KeyHash:   database.HashToken(plaintext),
+		UserID:    userID,
+		Name:      params.Name,
+		Scopes:    scopes,
+		CreatedAt: now,
+	}
+	if params.ExpiresInSeconds > 0 {
+		expiresAt := now.Add(time.Duration(params.ExpiresInSeconds) * time.Second)
+		key.ExpiresAt = &expiresAt
+	}
+
+	err = cfg.DB.CreateAPIKey(key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create API key")
+		return
+	}
+
+	resp := apiKeyResponse(key)
+	resp.Key = plaintext
+	respondWithJSON(w, http.StatusCreated, resp)
+}
+
+func (cfg *apiConfig) handlerAPIKeysList(w http.ResponseWriter, r *http.Request) {
+	userID, _ := auth.UserIDFromContext(r.Context())
+
+	keys, err := cfg.DB.GetUserAPIKeys(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve API keys")
+		return
+	}
+
+	resp := []APIKey{}
+	for _, key := range keys {
+		resp = append(resp, apiKeyResponse(key))
+	}
+	sort.Slice(resp, func(i, j int) bool {
+		return resp[i].CreatedAt.After(resp[j].CreatedAt)
+	})
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg *apiConfig) handlerAPIKeyDelete(w http.ResponseWriter, r *http.Request) {
+	userID, _ := auth.UserIDFromContext(r.Context())
+
+	err := cfg.DB.DeleteAPIKey(userID, r.PathValue("keyID"))
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "The API key does not exist")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete API key")
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, struct{}{})
+}
+
+// verifyAPIKey is the auth.APIKeyVerifier for personal API keys.
+func (cfg *apiConfig) verifyAPIKey(plaintext string) (int, []string, error) {
+	keyHash := database.HashToken(plaintext)
+	key, err := cfg.DB.GetAPIKey(keyHash)
+	if errors.Is(err, database.ErrNotFound) {
+		return 0, nil, auth.ErrInvalidAPIKey
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	now := time.Now().UTC()
+	if key.ExpiresAt != nil && now.After(*key.ExpiresAt) {
+		return 0, nil, auth.ErrInvalidAPIKey
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyTouchInterval {
+		err = cfg.DB.TouchAPIKey(keyHash, now)
+		if err != nil {
+			log.Printf("Error recording use of API key %s: %s", key.ID, err)
+		}
+	}
+	return key.UserID, key.Scopes, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/creighbattle/chirpy/auth"
+	"github.com/creighbattle/chirpy/database"
+)
+
+// createTestAPIKey creates an API key through the API and returns its
+// "Authorization" header value.
+func createTestAPIKey(t *testing.T, srv *httptest.Server, token string) string {
+	t.Helper()
+	key := APIKey{}
+	code := doRequest(t, srv, "POST", "/api/keys", token, map[string]any{"name": "bot", "scopes": []string{auth.ScopeChirpsWrite}}, &key)
+	if code != http.StatusCreated {
+		t.Fatalf("creating API key: got %d, want %d", code, http.StatusCreated)
+	}
+	return "ApiKey " + key.Key
+}
+
+func TestAPIKeyOnlyWritesChirps(t *testing.T) {
+	cfg := newTestConfig(t, database.NewMemoryDB())
+	srv := newTestServer(t, cfg)
+	user := createTestUser(t, cfg, "bot-owner@example.com")
+	apiKey := createTestAPIKey(t, srv, testToken(t, cfg, user.ID))
+
+	chirp := Chirp{}
+	code := doRequest(t, srv, "POST", "/api/chirps", apiKey, map[string]string{"body": "beep"}, &chirp)
+	if code != http.StatusCreated {
+		t.Fatalf("creating chirp: got %d, want %d", code, http.StatusCreated)
+	}
+	code = doRequest(t, srv, "DELETE", "/api/chirps/"+strconv.Itoa(chirp.ID), apiKey, nil, nil)
+	if code != http.StatusNoContent {
+		t.Fatalf("deleting chirp: got %d, want %d", code, http.StatusNoContent)
+	}
+
+	for _, route := range []struct{ method, path string }{
+		{"PUT", "/api/users"},
+		{"GET", "/api/sessions"},
+		{"POST", "/api/logout-all"},
+		{"GET", "/api/keys"},
+		{"POST", "/api/users/2fa/setup"},
+	} {
+		code := doRequest(t, srv, route.method, route.path, apiKey, map[string]string{}, nil)
+		if code != http.StatusForbidden {
+			t.Errorf("%s %s: got %d, want %d", route.method, route.path, code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestAPIKeysRevokedWithSessions(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		revoke func(t *testing.T, cfg *apiConfig, srv *httptest.Server, user database.UserResponse, token string)
+	}{
+		{"logout all", func(t *testing.T, cfg *apiConfig, srv *httptest.Server, user database.UserResponse, token string) {
+			code := doRequest(t, srv, "POST", "/api/logout-all", token, nil, nil)
+			if code != http.StatusNoContent {
+				t.Fatalf("got %d, want %d", code, http.StatusNoContent)
+			}
+		}},
+		{"password change", func(t *testing.T, cfg *apiConfig, srv *httptest.Server, user database.UserResponse, token string) {
+			code := doRequest(t, srv, "PUT", "/api/users", token, map[string]string{"email": user.Email, "password": "amber-lantern-93"}, nil)
+			if code != http.StatusOK {
+				t.Fatalf("got %d, want %d", code, http.StatusOK)
+			}
+		}},
+		{"password reset", func(t *testing.T, cfg *apiConfig, srv *httptest.Server, user database.UserResponse, token string) {
+			resetToken, err := cfg.issueOneTimeToken(user.ID, user.Email, database.PurposePasswordReset, passwordResetTTL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			code := doRequest(t, srv, "POST", "/api/password-reset/confirm", "", map[string]string{"token": resetToken, "password": "amber-lantern-93"}, nil)
+			if code != http.StatusNoContent {
+				t.Fatalf("got %d, want %d", code, http.StatusNoContent)
+			}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := newTestConfig(t, database.NewMemoryDB())
+			srv := newTestServer(t, cfg)
+			user := createTestUser(t, cfg, "bot-owner@example.com")
+			token := testToken(t, cfg, user.ID)
+			apiKey := createTestAPIKey(t, srv, token)
+
+			tc.revoke(t, cfg, srv, user, token)
+
+			code := doRequest(t, srv, "POST", "/api/chirps", apiKey, map[string]string{"body": "beep"}, nil)
+			if code != http.StatusUnauthorized {
+				t.Fatalf("API key after %s: got %d, want %d", tc.name, code, http.StatusUnauthorized)
+			}
+		})
+	}
+}
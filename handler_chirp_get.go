@@ -1,34 +1,33 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
+
+	"github.com/creighbattle/chirpy/database"
 )
 
 func (cfg *apiConfig) handlerChripRetrieve(w http.ResponseWriter, r *http.Request) {
-
-	dbChrips, err := cfg.DB.LoadDB()
+	chirpID, err := strconv.Atoi(r.PathValue("chirpID"))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Coudn't retrieve chirps")
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
 		return
 	}
-	pathValue := r.PathValue("chirpID")
-
-
-	pathValueInt, _ := strconv.Atoi(pathValue)
 
-	val, ok := dbChrips.Chirps[pathValueInt]
-
-	
-
-	if !ok {
+	dbChirp, err := cfg.DB.GetChirp(chirpID)
+	if errors.Is(err, database.ErrNotFound) {
 		respondWithError(w, http.StatusNotFound, "The Chirp does not exist")
 		return
 	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Coudn't retrieve chirp")
+		return
+	}
 
-	respondWithJSON(w, http.StatusOK, val)
-
-
-
-
-}
\ No newline at end of file
+	respondWithJSON(w, http.StatusOK, Chirp{
+		ID:       dbChirp.ID,
+		Body:     dbChirp.Body,
+		AuthorID: dbChirp.AuthorID,
+	})
+}
@@ -4,43 +4,31 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
-	"strconv"
 	"strings"
 
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/creighbattle/chirpy/auth"
 )
 
 type Chirp struct {
-	ID   int    `json:"id"`
-	Body string `json:"body"`
-	AuthorID int `json:"author_id"`
+	ID       int    `json:"id"`
+	Body     string `json:"body"`
+	AuthorID int    `json:"author_id"`
 }
 
 func (cfg *apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request) {
 
-	accessToken := r.Header.Get("Authorization")
-	if len(accessToken) == 0 {
-		respondWithError(w, http.StatusUnauthorized, "access token required")
-		return
-	}
-	accessToken = accessToken[7:]
-
-	claims := &jwt.RegisteredClaims{}
-	token, err := jwt.ParseWithClaims(accessToken, claims, func(token *jwt.Token) (interface{}, error) {
-    	return cfg.jwtSecret, nil
-	})
+	userIdInt, _ := auth.UserIDFromContext(r.Context())
 
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Invalid token")
-		return
-	}
-
-	userId, err := token.Claims.GetSubject()
-	userIdInt, _ := strconv.Atoi(userId)
-	
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Subject not found")
-		return
+	if cfg.requireVerifiedEmail {
+		user, err := cfg.DB.GetUser(userIdInt)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error getting user")
+			return
+		}
+		if !user.EmailVerified {
+			respondWithError(w, http.StatusForbidden, "Verify your email address before posting")
+			return
+		}
 	}
 
 	type parameters struct {
@@ -49,7 +37,7 @@ func (cfg *apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request
 
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	err = decoder.Decode(&params)
+	err := decoder.Decode(&params)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
 		return
@@ -68,8 +56,8 @@ func (cfg *apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request
 	}
 
 	respondWithJSON(w, http.StatusCreated, Chirp{
-		ID:   chirp.ID,
-		Body: chirp.Body,
+		ID:       chirp.ID,
+		Body:     chirp.Body,
 		AuthorID: userIdInt,
 	})
 }
@@ -99,4 +87,4 @@ func getCleanedBody(body string, badWords map[string]struct{}) string {
 	}
 	cleaned := strings.Join(words, " ")
 	return cleaned
-}
\ No newline at end of file
+}
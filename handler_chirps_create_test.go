@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/creighbattle/chirpy/database"
+)
+
+func TestChirpsCreateConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	fileDB, err := database.NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		db   *database.DB
+	}{
+		{"memory", database.NewMemoryDB()},
+		{"file", fileDB},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := newTestConfig(t, tc.db)
+			srv := newTestServer(t, cfg)
+			user := createTestUser(t, cfg, "chirper@example.com")
+			token := testToken(t, cfg, user.ID)
+
+			const n = 50
+			ids := make(chan int, n)
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					chirp := Chirp{}
+					code := doRequest(t, srv, http.MethodPost, "/api/chirps", token, map[string]string{"body": fmt.Sprintf("chirp %d", i)}, &chirp)
+					if code != http.StatusCreated {
+						t.Errorf("chirp %d: got status %d", i, code)
+						return
+					}
+					ids <- chirp.ID
+				}(i)
+			}
+			wg.Wait()
+			close(ids)
+
+			seen := map[int]bool{}
+			for id := range ids {
+				if seen[id] {
+					t.Errorf("chirp ID %d handed out twice", id)
+				}
+				seen[id] = true
+			}
+
+			chirps, err := tc.db.GetChirps()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chirps) != n {
+				t.Errorf("stored %d chirps, want %d", len(chirps), n)
+			}
+			for _, chirp := range chirps {
+				if !seen[chirp.ID] {
+					t.Errorf("stored chirp %d was never returned", chirp.ID)
+				}
+			}
+		})
+	}
+
+	// Nothing may have been lost on the way to disk.
+	reopened, err := database.NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirps, err := reopened.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 50 {
+		t.Errorf("file holds %d chirps after reopening, want 50", len(chirps))
+	}
+}
@@ -1,52 +1,35 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/creighbattle/chirpy/auth"
+	"github.com/creighbattle/chirpy/database"
 )
 
 func (cfg *apiConfig) handlerDeleteChirp(w http.ResponseWriter, r *http.Request) {
 
-	
 	chirpId := r.PathValue("chirpID")
 	chirpIdInt, _ := strconv.Atoi(chirpId)
 
-	accessToken := r.Header.Get("Authorization")
-	if len(accessToken) == 0 {
-		respondWithError(w, http.StatusUnauthorized, "access token required")
-		return
-	}
-	accessToken = accessToken[7:]
-
-	claims := &jwt.RegisteredClaims{}
-	token, err := jwt.ParseWithClaims(accessToken, claims, func(token *jwt.Token) (interface{}, error) {
-    	return cfg.jwtSecret, nil
-	})
+	userIdInt, _ := auth.UserIDFromContext(r.Context())
 
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Invalid token")
+	err := cfg.DB.DeleteChirp(userIdInt, chirpIdInt)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "The Chirp does not exist")
 		return
 	}
-
-	userId, err := token.Claims.GetSubject()
-	userIdInt, _ := strconv.Atoi(userId)
-	
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Subject not found")
+	if errors.Is(err, database.ErrForbidden) {
+		respondWithError(w, http.StatusForbidden, "forbidden")
 		return
 	}
-
-	err = cfg.DB.DeleteChirp(userIdInt, chirpIdInt)
-
 	if err != nil {
-		respondWithError(w, http.StatusForbidden, "forbidden")
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete chirp")
 		return
 	}
 
 	respondWithJSON(w, http.StatusNoContent, struct{}{})
 
-
-
-}
\ No newline at end of file
+}
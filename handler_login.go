@@ -4,28 +4,30 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"log"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/creighbattle/chirpy/auth"
+	"github.com/creighbattle/chirpy/database"
 )
 
-func (cfg *apiConfig) handlerLogin (w http.ResponseWriter, r *http.Request) {
+// mfaChallengeTTL is how long a user has to enter their second factor after
+// their password.
+const mfaChallengeTTL = 5 * time.Minute
 
-	type parameters struct {
-		Email string `json:"email"`
-		Password string `json:"password"`
-		ExpiresInSeconds int `json:"expires_in_seconds"`
-	}
+func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 
-	type response struct {
-		Email string `json:"email"`
-		ID int `json:"id"`
-		Token string `json:"token"`
-		RefreshToken string `json:"refresh_token"`
-		IsChirpyRed bool `json:"is_chirpy_red"`
+	type parameters struct {
+		Email            string   `json:"email"`
+		Password         string   `json:"password"`
+		ExpiresInSeconds int      `json:"expires_in_seconds"`
+		Device           string   `json:"device"`
+		Scopes           []string `json:"scopes"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -35,48 +37,152 @@ func (cfg *apiConfig) handlerLogin (w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
 		return
 	}
+	scopes, err := auth.NarrowScopes(auth.AllScopes, params.Scopes)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	db, _ := cfg.DB.LoadDB()
-
-	id, ok := db.Emails[params.Email]
-	if !ok {
-		respondWithError(w, http.StatusNotFound, "Email does not exist")
+	if cfg.loginLockedOut(w, r, nil, "") {
 		return
 	}
 
-	user, ok := db.Users[id]
-	if !ok {
+	// Unknown emails and wrong passwords get the same response, and take as
+	// long, so the endpoint can't be used to find out who has an account.
+	user, err := cfg.DB.GetUserByEmail(params.Email)
+	if errors.Is(err, database.ErrNotFound) {
+		if cfg.loginLockedOut(w, r, nil, params.Email) {
+			return
+		}
+		cfg.checkPassword(nil, params.Password)
+		cfg.loginFailed(r, nil, params.Email)
+		respondWithError(w, http.StatusUnauthorized, errLoginFailed.Error())
+		return
+	}
+	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error getting user")
 		return
 	}
+	if cfg.loginLockedOut(w, r, &user, "") {
+		return
+	}
+
+	if !cfg.checkPassword(&user, params.Password) {
+		cfg.loginFailed(r, &user, "")
+		respondWithError(w, http.StatusUnauthorized, errLoginFailed.Error())
+		return
+	}
+
+	if user.TOTPEnabled {
+		cfg.respondWithMFAChallenge(w, user, scopes)
+		return
+	}
+
+	cfg.loginSucceeded(user)
+	cfg.respondWithSession(w, r, user, params.Device, params.ExpiresInSeconds, scopes)
+}
+
+var errLoginFailed = errors.New("Incorrect email or password")
+
+// loginLockedOut responds with 429 if the client IP, or the user (or, when
+// user is nil and email is set, the unknown email address), has been locked
+// out by too many failed logins.
+func (cfg *apiConfig) loginLockedOut(w http.ResponseWriter, r *http.Request, user *database.User, email string) bool {
+	now := time.Now()
+	retryAfter := cfg.ipThrottle.retryAfter(clientIP(r), now)
+	if user != nil && user.LockedUntil != nil && user.LockedUntil.Sub(now) > retryAfter {
+		retryAfter = user.LockedUntil.Sub(now)
+	}
+	if user == nil && email != "" {
+		retryAfter = max(retryAfter, cfg.emailThrottle.retryAfter(strings.ToLower(email), now))
+	}
+	if retryAfter <= 0 {
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	respondWithError(w, http.StatusTooManyRequests, "Too many failed login attempts, try again later")
+	return true
+}
+
+// loginFailed counts a failed password or second factor against the client IP
+// and the account, locking them out once there have been too many.
+func (cfg *apiConfig) loginFailed(r *http.Request, user *database.User, email string) {
+	now := time.Now()
+	cfg.ipThrottle.fail(clientIP(r), now)
+	if user == nil {
+		cfg.emailThrottle.fail(strings.ToLower(email), now)
+		return
+	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(params.Password))
+	failures, err := cfg.DB.RecordFailedLogin(user.ID, now, accountFailureWindow)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Passwords do not match")
+		log.Printf("Error recording failed login for user %d: %s", user.ID, err)
 		return
 	}
+	if d := accountBackoff.lockout(failures); d > 0 {
+		err = cfg.DB.LockUser(user.ID, now.Add(d))
+		if err != nil {
+			log.Printf("Error locking user %d: %s", user.ID, err)
+			return
+		}
+		log.Printf("security: locked user %d out for %s after %d failed logins from %s", user.ID, d, failures, clientIP(r))
+	}
+}
+
+// loginSucceeded resets the account's failed logins once the user has fully
+// logged in, second factor included.
+func (cfg *apiConfig) loginSucceeded(user database.User) {
+	if user.FailedLogins == 0 && user.LockedUntil == nil {
+		return
+	}
+	err := cfg.DB.UnlockUser(user.ID)
+	if err != nil {
+		log.Printf("Error resetting failed logins for user %d: %s", user.ID, err)
+	}
+}
+
+// respondWithMFAChallenge asks a user who has two-factor authentication on
+// for their second factor, via handlerLogin2FA.
+func (cfg *apiConfig) respondWithMFAChallenge(w http.ResponseWriter, user database.User, scopes []string) {
+	mfaToken, err := auth.MakeMFAChallenge(user.ID, scopes, cfg.jwtKeys, mfaChallengeTTL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not sign token")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+	}{
+		MFARequired: true,
+		MFAToken:    mfaToken,
+	})
+}
+
+// respondWithSession starts a new session for a user who has fully logged in
+// and responds with its access and refresh tokens, which are good for scopes.
+func (cfg *apiConfig) respondWithSession(w http.ResponseWriter, r *http.Request, user database.User, device string, expiresInSeconds int, scopes []string) {
+	type response struct {
+		Email         string   `json:"email"`
+		EmailVerified bool     `json:"email_verified"`
+		ID            int      `json:"id"`
+		Token         string   `json:"token"`
+		RefreshToken  string   `json:"refresh_token"`
+		IsChirpyRed   bool     `json:"is_chirpy_red"`
+		Scopes        []string `json:"scopes"`
+	}
+	id := user.ID
 
 	// Get the current UTC time
 	currentTime := time.Now().UTC()
 
-	expireTime := params.ExpiresInSeconds
+	expireTime := expiresInSeconds
 
 	if expireTime == 0 || expireTime > 3600 {
 		expireTime = 3600
 	}
 
-	
-	jwtRegisteredClaims := jwt.RegisteredClaims{
-		Issuer: "chirpy",
-		IssuedAt: jwt.NewNumericDate(currentTime),
-		ExpiresAt: jwt.NewNumericDate(currentTime.Add(time.Duration(expireTime) * time.Second)),
-		Subject: strconv.Itoa(id),
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwtRegisteredClaims)
-
-	signedJwtToken, err := token.SignedString(cfg.jwtSecret)
-
+	signedJwtToken, accessToken, err := auth.MakeJWT(id, scopes, cfg.jwtKeys, time.Duration(expireTime)*time.Second)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Could not sign token")
 		return
@@ -90,18 +196,36 @@ func (cfg *apiConfig) handlerLogin (w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	futureTime := currentTime.Add(time.Duration(1440) * time.Hour)
-	futureTimeString := futureTime.Format(time.RFC3339)
+	if device == "" {
+		device = r.UserAgent()
+	}
 
-	err = cfg.DB.UpdateRefreshToken(id, hex.EncodeToString(b), futureTimeString)
+	sessionID := make([]byte, 16)
+	_, err = rand.Read(sessionID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	
-	respondWithJSON(w, http.StatusOK, response{Email: user.Email, ID: id, Token: signedJwtToken, RefreshToken: hex.EncodeToString(b), IsChirpyRed: user.IsChirpyRed})
+	err = cfg.DB.CreateRefreshToken(database.RefreshToken{
+		ID:         hex.EncodeToString(sessionID),
+		TokenHash:  database.HashToken(hex.EncodeToString(b)),
+		UserID:     id,
+		IP:         clientIP(r),
+		Device:     device,
+		CreatedAt:  currentTime,
+		LastUsedAt: currentTime,
+		ExpiresAt:  currentTime.Add(time.Duration(1440) * time.Hour),
+
+		AccessTokenID:        accessToken.ID,
+		AccessTokenExpiresAt: accessToken.ExpiresAt,
+		Scopes:               scopes,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
 
-	
+	respondWithJSON(w, http.StatusOK, response{Email: user.Email, EmailVerified: user.EmailVerified, ID: id, Token: signedJwtToken, RefreshToken: hex.EncodeToString(b), IsChirpyRed: user.IsChirpyRed, Scopes: scopes})
 
-}
\ No newline at end of file
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/creighbattle/chirpy/auth"
+	"github.com/creighbattle/chirpy/database"
+	"github.com/creighbattle/chirpy/oidc"
+)
+
+// oidcLoginTTL is how long a user has to log in at the provider.
+const oidcLoginTTL = 10 * time.Minute
+
+var (
+	errProviderEmailUnverified = errors.New("The provider has not verified your email address")
+	errLocalEmailUnverified    = errors.New("An account with this email address exists but its address is not verified; verify it or log in with your password first")
+)
+
+func oidcCookieName(provider string) string {
+	return "chirpy_oidc_" + provider
+}
+
+// handlerOIDCStart sends the user to log in at the provider, remembering the
+// state, nonce and PKCE verifier in a cookie for handlerOIDCCallback.
+func (cfg *apiConfig) handlerOIDCStart(w http.ResponseWriter, r *http.Request) {
+	provider, ok := cfg.oidcProviders[r.PathValue("provider")]
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Unknown login provider")
+		return
+	}
+
+	state := auth.OIDCState{Provider: provider.Name}
+	var err error
+	state.State, err = oidc.RandomString()
+	if err == nil {
+		state.Nonce, err = oidc.RandomString()
+	}
+	var challenge string
+	if err == nil {
+		state.CodeVerifier, challenge, err = oidc.NewPKCE()
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), state.State, state.Nonce, challenge)
+	if err != nil {
+		log.Printf("Error starting %s login: %s", provider.Name, err)
+		respondWithError(w, http.StatusBadGateway, "Couldn't reach the login provider")
+		return
+	}
+
+	cookie, err := auth.MakeOIDCState(state, cfg.jwtKeys, oidcLoginTTL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not sign token")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName(provider.Name),
+		Value:    cookie,
+		Path:     "/api/auth/" + provider.Name + "/",
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(cfg.publicURL, "https://"),
+		// Lax, since the provider redirects back with a top-level GET.
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// handlerOIDCCallback finishes the login the provider redirected back from
+// and responds just like handlerLogin.
+func (cfg *apiConfig) handlerOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := cfg.oidcProviders[r.PathValue("provider")]
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Unknown login provider")
+		return
+	}
+
+	// The cookie is only good for one try.
+	http.SetCookie(w, &http.Cookie{
+		Name:   oidcCookieName(provider.Name),
+		Path:   "/api/auth/" + provider.Name + "/",
+		MaxAge: -1,
+	})
+
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		respondWithError(w, http.StatusUnauthorized, "Login failed at the provider: "+errCode)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcCookieName(provider.Name))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Login expired or was started in another browser")
+		return
+	}
+	state, err := auth.ValidateOIDCState(cookie.Value, cfg.jwtKeys)
+	if err != nil || state.Provider != provider.Name {
+		respondWithError(w, http.StatusBadRequest, "Login expired or was started in another browser")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state.State)) != 1 {
+		respondWithError(w, http.StatusBadRequest, "Login state does not match")
+		return
+	}
+
+	claims, err := provider.Exchange(r.Context(), query.Get("code"), state.CodeVerifier, state.Nonce)
+	if err != nil {
+		log.Printf("Error finishing %s login: %s", provider.Name, err)
+		respondWithError(w, http.StatusUnauthorized, "Couldn't verify login with the provider")
+		return
+	}
+
+	user, err := cfg.userForIdentity(provider.Name, claims)
+	if errors.Is(err, errProviderEmailUnverified) {
+		respondWithError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if errors.Is(err, errLocalEmailUnverified) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error linking %s identity %s: %s", provider.Name, claims.Subject, err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't log in")
+		return
+	}
+
+	if user.TOTPEnabled {
+		cfg.respondWithMFAChallenge(w, user, auth.AllScopes)
+		return
+	}
+	cfg.respondWithSession(w, r, user, "", 0, auth.AllScopes)
+}
+
+// userForIdentity returns the user linked to the provider's account. The
+// first time, that is the user with the same email address, or a new one,
+// as long as the provider vouches for the address. An existing user's
+// address must be verified too, or whoever signed up with someone else's
+// address could have their SSO login land in the squatted account.
+func (cfg *apiConfig) userForIdentity(provider string, claims oidc.Claims) (database.User, error) {
+	identity, err := cfg.DB.GetIdentity(provider, claims.Subject)
+	if err == nil {
+		return cfg.DB.GetUser(identity.UserID)
+	}
+	if !errors.Is(err, database.ErrNotFound) {
+		return database.User{}, err
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return database.User{}, errProviderEmailUnverified
+	}
+
+	user, err := cfg.DB.GetUserByEmail(claims.Email)
+	if errors.Is(err, database.ErrNotFound) {
+		user, err = cfg.createOIDCUser(claims.Email)
+	} else if err == nil && !user.EmailVerified {
+		return database.User{}, errLocalEmailUnverified
+	}
+	if err != nil {
+		return database.User{}, err
+	}
+
+	err = cfg.DB.CreateIdentity(database.Identity{
+		Provider:  provider,
+		Subject:   claims.Subject,
+		UserID:    user.ID,
+		Email:     claims.Email,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return database.User{}, err
+	}
+	log.Printf("Linked %s identity %s to user %d", provider, claims.Subject, user.ID)
+	return user, nil
+}
+
+// createOIDCUser signs up a user who came from a provider. Their password is
+// random; they can set one with a password reset if they want one.
+func (cfg *apiConfig) createOIDCUser(email string) (database.User, error) {
+	err := validateEmail(email)
+	if err != nil {
+		return database.User{}, err
+	}
+
+	password := make([]byte, 32)
+	_, err = rand.Read(password)
+	if err != nil {
+		return database.User{}, err
+	}
+	passwordHash, err := cfg.passwordHasher.Hash(hex.EncodeToString(password))
+	if err != nil {
+		return database.User{}, err
+	}
+
+	created, err := cfg.DB.CreateUser(email, passwordHash)
+	if err != nil {
+		return database.User{}, err
+	}
+	err = cfg.DB.SetEmailVerified(created.ID, email)
+	if err != nil {
+		return database.User{}, err
+	}
+	return cfg.DB.GetUser(created.ID)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/creighbattle/chirpy/auth"
+	"github.com/creighbattle/chirpy/database"
+	"github.com/creighbattle/chirpy/oidc"
+	"github.com/creighbattle/chirpy/oidc/oidctest"
+)
+
+// oidcTest is a chirpy server with the provider "mock", and a browser for
+// logging in with it.
+type oidcTest struct {
+	cfg    *apiConfig
+	issuer *oidctest.Issuer
+	client *http.Client
+	srvURL string
+}
+
+func newOIDCTest(t *testing.T) *oidcTest {
+	t.Helper()
+	cfg := newTestConfig(t, database.NewMemoryDB())
+	srv := newTestServer(t, cfg)
+	issuer := oidctest.NewIssuer(t, "chirpy")
+	cfg.oidcProviders = map[string]*oidc.Provider{
+		"mock": {
+			Name:        "mock",
+			IssuerURL:   issuer.URL,
+			ClientID:    "chirpy",
+			RedirectURL: srv.URL + "/api/auth/mock/callback",
+		},
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Jar: jar,
+		// Stop at the callback, so tests can tamper with it first.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if strings.HasSuffix(req.URL.Path, "/callback") {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	return &oidcTest{cfg: cfg, issuer: issuer, client: client, srvURL: srv.URL}
+}
+
+// start logs user in at the provider and returns the callback it redirects
+// back to.
+func (o *oidcTest) start(t *testing.T, user oidctest.User) *url.URL {
+	t.Helper()
+	o.issuer.SetUser(user)
+	resp, err := o.client.Get(o.srvURL + "/api/auth/mock/start")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("start: got %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+	callback, err := resp.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return callback
+}
+
+// callback finishes the login and returns the status code and the user it
+// logged in as.
+func (o *oidcTest) callback(t *testing.T, callback *url.URL) (int, database.UserResponse) {
+	t.Helper()
+	resp, err := o.client.Get(callback.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	user := database.UserResponse{}
+	if resp.StatusCode == http.StatusOK {
+		err = json.NewDecoder(resp.Body).Decode(&user)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, user
+}
+
+// editState changes the login state in the cookie, signed like the real one.
+func (o *oidcTest) editState(t *testing.T, edit func(state *auth.OIDCState)) {
+	t.Helper()
+	cookieURL, err := url.Parse(o.srvURL + "/api/auth/mock/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range o.client.Jar.Cookies(cookieURL) {
+		if cookie.Name != oidcCookieName("mock") {
+			continue
+		}
+		state, err := auth.ValidateOIDCState(cookie.Value, o.cfg.jwtKeys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		edit(&state)
+		cookie.Value, err = auth.MakeOIDCState(state, o.cfg.jwtKeys, oidcLoginTTL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cookie.Path = "/api/auth/mock/"
+		o.client.Jar.SetCookies(cookieURL, []*http.Cookie{cookie})
+		return
+	}
+	t.Fatal("no login state cookie")
+}
+
+var alice = oidctest.User{Subject: "alice-sub", Email: "alice@example.com", EmailVerified: true}
+
+func TestOIDCLoginCreatesUser(t *testing.T) {
+	o := newOIDCTest(t)
+
+	code, user := o.callback(t, o.start(t, alice))
+	if code != http.StatusOK {
+		t.Fatalf("got %d, want %d", code, http.StatusOK)
+	}
+	if user.Email != alice.Email || !user.EmailVerified {
+		t.Fatalf("got user %+v, want verified %s", user, alice.Email)
+	}
+
+	// Logging in again goes through the identity linked the first time.
+	code, _ = o.callback(t, o.start(t, alice))
+	if code != http.StatusOK {
+		t.Fatalf("second login: got %d, want %d", code, http.StatusOK)
+	}
+	identity, err := o.cfg.DB.GetIdentity("mock", alice.Subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.UserID != user.ID {
+		t.Fatalf("identity is linked to user %d, want %d", identity.UserID, user.ID)
+	}
+}
+
+func TestOIDCLoginLinksVerifiedEmail(t *testing.T) {
+	o := newOIDCTest(t)
+	existing := createTestUser(t, o.cfg, alice.Email)
+	err := o.cfg.DB.SetEmailVerified(existing.ID, alice.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, user := o.callback(t, o.start(t, alice))
+	if code != http.StatusOK {
+		t.Fatalf("got %d, want %d", code, http.StatusOK)
+	}
+	if user.ID != existing.ID {
+		t.Fatalf("logged in as user %d, want %d", user.ID, existing.ID)
+	}
+}
+
+func TestOIDCLoginRefusesUnverifiedEmail(t *testing.T) {
+	t.Run("at the provider", func(t *testing.T) {
+		o := newOIDCTest(t)
+		unverified := alice
+		unverified.EmailVerified = false
+
+		code, _ := o.callback(t, o.start(t, unverified))
+		if code != http.StatusForbidden {
+			t.Fatalf("got %d, want %d", code, http.StatusForbidden)
+		}
+		_, err := o.cfg.DB.GetUserByEmail(alice.Email)
+		if !errors.Is(err, database.ErrNotFound) {
+			t.Fatalf("user was created: %v", err)
+		}
+	})
+
+	t.Run("locally", func(t *testing.T) {
+		o := newOIDCTest(t)
+		createTestUser(t, o.cfg, alice.Email)
+
+		code, _ := o.callback(t, o.start(t, alice))
+		if code != http.StatusConflict {
+			t.Fatalf("got %d, want %d", code, http.StatusConflict)
+		}
+		_, err := o.cfg.DB.GetIdentity("mock", alice.Subject)
+		if !errors.Is(err, database.ErrNotFound) {
+			t.Fatalf("identity was linked: %v", err)
+		}
+	})
+}
+
+func TestOIDCCallbackRejectsTampering(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		tamper func(t *testing.T, o *oidcTest, callback *url.URL)
+		want   int
+	}{
+		{"state", func(t *testing.T, o *oidcTest, callback *url.URL) {
+			q := callback.Query()
+			q.Set("state", "forged")
+			callback.RawQuery = q.Encode()
+		}, http.StatusBadRequest},
+		{"nonce", func(t *testing.T, o *oidcTest, callback *url.URL) {
+			o.editState(t, func(state *auth.OIDCState) { state.Nonce = "forged" })
+		}, http.StatusUnauthorized},
+		{"code verifier", func(t *testing.T, o *oidcTest, callback *url.URL) {
+			o.editState(t, func(state *auth.OIDCState) { state.CodeVerifier = "forged" })
+		}, http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			o := newOIDCTest(t)
+			callback := o.start(t, alice)
+			tc.tamper(t, o, callback)
+
+			code, _ := o.callback(t, callback)
+			if code != tc.want {
+				t.Fatalf("got %d, want %d", code, tc.want)
+			}
+			_, err := o.cfg.DB.GetUserByEmail(alice.Email)
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Fatalf("user was created: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/creighbattle/chirpy/database"
+	"github.com/creighbattle/chirpy/mail"
+)
+
+const passwordResetTTL = time.Hour
+
+var (
+	// resetEmailBackoff allows one reset email per address and makes each
+	// further one wait longer, so the endpoint can't flood someone's inbox.
+	resetEmailBackoff = backoff{freeAttempts: 1, base: 5 * time.Minute, max: time.Hour}
+	// resetIPBackoff stops one client from mailing many addresses.
+	resetIPBackoff = backoff{freeAttempts: 10, base: 5 * time.Minute, max: time.Hour}
+)
+
+// handlerPasswordResetRequest mails a reset token to the address if it
+// belongs to a user and the request isn't throttled. The response is the same
+// either way so it can't be used to find out who has an account.
+func (cfg *apiConfig) handlerPasswordResetRequest(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	// Addresses are counted whether or not they have an account, so
+	// throttling gives nothing away either.
+	now := time.Now()
+	if !cfg.resetIPThrottle.allow(clientIP(r), now) || !cfg.resetEmailThrottle.allow(strings.ToLower(params.Email), now) {
+		respondWithJSON(w, http.StatusAccepted, struct{}{})
+		return
+	}
+
+	user, err := cfg.DB.GetUserByEmail(params.Email)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithJSON(w, http.StatusAccepted, struct{}{})
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting user")
+		return
+	}
+
+	token, err := cfg.issueOneTimeToken(user.ID, user.Email, database.PurposePasswordReset, passwordResetTTL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create reset token")
+		return
+	}
+
+	cfg.sendMail(mail.Message{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your Chirpy account. If it was you, your reset token is\n\n"+
+			"%s\n\n"+
+			"To choose a new password, send it within the hour as\n\n"+
+			"POST %s/api/password-reset/confirm\n"+
+			"{\"token\": \"<reset token>\", \"password\": \"<new password>\"}\n\n"+
+			"If it wasn't you, you can ignore this email.\n",
+			token, cfg.publicURL),
+	})
+
+	respondWithJSON(w, http.StatusAccepted, struct{}{})
+}
+
+func (cfg *apiConfig) handlerPasswordResetConfirm(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	tokenHash := database.HashToken(params.Token)
+	now := time.Now().UTC()
+
+	// Check the password before using up the token, so the user can try
+	// again with a better one.
+	token, err := cfg.DB.GetOneTimeToken(tokenHash, database.PurposePasswordReset, now)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired reset token")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check reset token")
+		return
+	}
+	errs, err := cfg.validatePassword(params.Password, token.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check password")
+		return
+	}
+	if len(errs) > 0 {
+		respondWithValidationErrors(w, errs)
+		return
+	}
+
+	token, err = cfg.DB.UseOneTimeToken(tokenHash, database.PurposePasswordReset, now)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired reset token")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check reset token")
+		return
+	}
+
+	passwordHash, err := cfg.passwordHasher.Hash(params.Password)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password")
+		return
+	}
+
+	err = cfg.DB.UpdateUserPassword(token.UserID, passwordHash)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update password")
+		return
+	}
+
+	err = cfg.DB.RevokeUserSessions(token.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions")
+		return
+	}
+
+	// Whoever reset the password owns the address, so the failed logins that
+	// locked the account were not theirs to pay for.
+	err = cfg.DB.UnlockUser(token.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't unlock account")
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, struct{}{})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/creighbattle/chirpy/database"
+	"github.com/creighbattle/chirpy/mail"
+)
+
+// waitForMailedToken waits for the one email that should have been sent in
+// the background and returns the token it calls "<kind> token".
+func waitForMailedToken(t *testing.T, cfg *apiConfig, kind string) string {
+	t.Helper()
+	pattern := regexp.MustCompile(kind + ` token is\s+(\S+)`)
+	dir := cfg.mailer.(*mail.OutboxMailer).Dir
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		entries, _ := os.ReadDir(dir)
+		if len(entries) > 0 {
+			if len(entries) > 1 {
+				t.Fatalf("got %d emails, want 1", len(entries))
+			}
+			dat, err := os.ReadFile(dir + "/" + entries[0].Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := pattern.FindSubmatch(dat)
+			if m == nil {
+				t.Fatalf("no %s token in %q", kind, dat)
+			}
+			return string(m[1])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no email with a %s token was sent", kind)
+	return ""
+}
+
+func TestPasswordReset(t *testing.T) {
+	cfg := newTestConfig(t, database.NewMemoryDB())
+	srv := newTestServer(t, cfg)
+	const email = "quillfeather@example.com"
+	user := createTestUser(t, cfg, email)
+
+	err := cfg.DB.LockUser(user.ID, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := doRequest(t, srv, "POST", "/api/password-reset/request", "", map[string]string{"email": email}, nil)
+	if code != http.StatusAccepted {
+		t.Fatalf("request: got %d, want %d", code, http.StatusAccepted)
+	}
+	token := waitForMailedToken(t, cfg, "reset")
+
+	// Weak only because it is made of the email address. Rejecting it must
+	// not use up the token.
+	code = doRequest(t, srv, "POST", "/api/password-reset/confirm", "", map[string]string{"token": token, "password": "quillfeather2024!"}, nil)
+	if code != http.StatusBadRequest {
+		t.Fatalf("confirm with weak password: got %d, want %d", code, http.StatusBadRequest)
+	}
+
+	const newPassword = "amber-lantern-93"
+	code = doRequest(t, srv, "POST", "/api/password-reset/confirm", "", map[string]string{"token": token, "password": newPassword}, nil)
+	if code != http.StatusNoContent {
+		t.Fatalf("confirm: got %d, want %d", code, http.StatusNoContent)
+	}
+
+	code = doRequest(t, srv, "POST", "/api/password-reset/confirm", "", map[string]string{"token": token, "password": "another-lantern-94"}, nil)
+	if code != http.StatusBadRequest {
+		t.Fatalf("confirm with used token: got %d, want %d", code, http.StatusBadRequest)
+	}
+
+	code = doRequest(t, srv, "POST", "/api/login", "", map[string]string{"email": email, "password": newPassword}, nil)
+	if code != http.StatusOK {
+		t.Fatalf("login with new password: got %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestPasswordResetRejectsStaleTokens(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		ttl   time.Duration
+		setup func(t *testing.T, cfg *apiConfig, userID int)
+	}{
+		{"expired", -time.Minute, nil},
+		{"email changed", time.Hour, func(t *testing.T, cfg *apiConfig, userID int) {
+			user, err := cfg.DB.GetUser(userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = cfg.DB.UpdateUser("new@example.com", user.Password, userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := newTestConfig(t, database.NewMemoryDB())
+			srv := newTestServer(t, cfg)
+			user := createTestUser(t, cfg, "old@example.com")
+
+			token, err := cfg.issueOneTimeToken(user.ID, user.Email, database.PurposePasswordReset, tc.ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.setup != nil {
+				tc.setup(t, cfg, user.ID)
+			}
+
+			code := doRequest(t, srv, "POST", "/api/password-reset/confirm", "", map[string]string{"token": token, "password": "amber-lantern-93"}, nil)
+			if code != http.StatusBadRequest {
+				t.Fatalf("got %d, want %d", code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestPasswordResetRequestThrottled(t *testing.T) {
+	cfg := newTestConfig(t, database.NewMemoryDB())
+	srv := newTestServer(t, cfg)
+	createTestUser(t, cfg, "jo@example.com")
+	createTestUser(t, cfg, "sam@example.com")
+
+	request := func(email string) {
+		t.Helper()
+		code := doRequest(t, srv, "POST", "/api/password-reset/request", "", map[string]string{"email": email}, nil)
+		if code != http.StatusAccepted {
+			t.Fatalf("request for %s: got %d, want %d", email, code, http.StatusAccepted)
+		}
+	}
+
+	request("jo@example.com")
+	waitForMailedToken(t, cfg, "reset")
+
+	// Throttled per address, however it is spelled, and per client.
+	request("JO@example.com")
+	for i := 2; i < resetIPBackoff.freeAttempts; i++ {
+		request(fmt.Sprintf("nobody%d@example.com", i))
+	}
+	request("sam@example.com")
+
+	time.Sleep(100 * time.Millisecond)
+	entries, err := os.ReadDir(cfg.mailer.(*mail.OutboxMailer).Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d emails, want 1", len(entries))
+	}
+}
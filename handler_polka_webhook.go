@@ -2,17 +2,20 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+
+	"github.com/creighbattle/chirpy/auth"
+	"github.com/creighbattle/chirpy/database"
 )
 
 func (cfg *apiConfig) handlerPolkaWebhook(w http.ResponseWriter, r *http.Request) {
 
-	apiKey := r.Header.Get("Authorization")
-	if len(apiKey) < 8 {
-		respondWithError(w, http.StatusUnauthorized, "api key required")
+	apiKey, err := auth.GetAPIKey(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
 		return
 	}
-	apiKey = apiKey[7:]
 
 	if apiKey != cfg.polkaKey {
 		respondWithError(w, http.StatusUnauthorized, "invalid api key")
@@ -21,14 +24,14 @@ func (cfg *apiConfig) handlerPolkaWebhook(w http.ResponseWriter, r *http.Request
 
 	type parameters struct {
 		Event string `json:"event"`
-		Data struct {
+		Data  struct {
 			UserID int `json:"user_id"`
 		} `json:"data"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	err := decoder.Decode(&params)
+	err = decoder.Decode(&params)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
 		return
@@ -44,17 +47,16 @@ func (cfg *apiConfig) handlerPolkaWebhook(w http.ResponseWriter, r *http.Request
 
 	err = cfg.DB.UpdateUserSubscription(userId)
 
-	if err != nil && err.Error() == "no user" {
+	if errors.Is(err, database.ErrNotFound) {
 		respondWithError(w, http.StatusNotFound, err.Error())
 		return
 	}
 
-	
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	
+
 	respondWithJSON(w, http.StatusNoContent, struct{}{})
 
-}
\ No newline at end of file
+}
@@ -1,70 +1,130 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
 	"net/http"
-	"strconv"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/creighbattle/chirpy/auth"
+	"github.com/creighbattle/chirpy/database"
 )
 
+// handlerRefresh rotates the refresh token and issues a new access token. The
+// request body is optional; its scopes narrow the access token, but not the
+// session, below what was granted at login.
 func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
-	refreshToken := r.Header.Get("Authorization")
-	refreshToken = refreshToken[7:]
+	type parameters struct {
+		Scopes []string `json:"scopes"`
+	}
+
+	refreshToken, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Refresh token required")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
 
-	dbStructure, err  := cfg.DB.LoadDB()
+	session, err := cfg.DB.GetRefreshToken(database.HashToken(refreshToken))
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusUnauthorized, "Refresh token does not exist")
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	users := dbStructure.Users
-	found := false
-	id := 0
-
-	for _, user := range users {
-		
-		if user.RefreshToken == refreshToken {
-			
-			found = true
-			parsedTime, err := time.Parse(time.RFC3339, user.Exp)
-			if err != nil {
-				respondWithError(w, http.StatusInternalServerError, err.Error())
-				return
-			}
-			if time.Now().After(parsedTime) {
-				respondWithError(w, http.StatusUnauthorized, "Refresh token has expired")
-				return
-			}
-			id = user.ID
-			break
+	// Check for reuse before anything that could turn the request away, or
+	// a stolen token could be replayed without ending the session.
+	if session.RotatedAt != nil {
+		err = cfg.DB.RevokeRefreshToken(session.TokenHash)
+		if err != nil && !errors.Is(err, database.ErrNotFound) {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
 		}
+		respondWithTokenReused(w, r, session)
+		return
 	}
+	if time.Now().After(session.ExpiresAt) {
+		respondWithError(w, http.StatusUnauthorized, "Refresh token has expired")
+		return
+	}
+	id := session.UserID
 
-	if !found {
-		respondWithError(w, http.StatusUnauthorized, "Refresh token does not exist")
+	scopes, err := auth.NarrowScopes(session.Scopes, params.Scopes)
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, err.Error())
 		return
 	}
 
 	currentTime := time.Now().UTC()
 
-	jwtRegisteredClaims := jwt.RegisteredClaims{
-		Issuer: "chirpy",
-		IssuedAt: jwt.NewNumericDate(currentTime),
-		ExpiresAt: jwt.NewNumericDate(currentTime.Add(time.Duration(3600) * time.Second)),
-		Subject: strconv.Itoa(id),
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
+	newRefreshToken := hex.EncodeToString(b)
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwtRegisteredClaims)
-
-	signedJwtToken, err := token.SignedString(cfg.jwtSecret)
+	signedJwtToken, accessToken, err := auth.MakeJWT(id, scopes, cfg.jwtKeys, time.Hour)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Could not sign token")
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, struct{Token string `json:"token"`}{
-		Token: signedJwtToken,
+	err = cfg.DB.RotateRefreshToken(database.HashToken(refreshToken), database.RefreshToken{
+		ID:         session.ID,
+		TokenHash:  database.HashToken(newRefreshToken),
+		UserID:     id,
+		Device:     session.Device,
+		IP:         clientIP(r),
+		CreatedAt:  session.CreatedAt,
+		LastUsedAt: currentTime,
+		ExpiresAt:  session.ExpiresAt,
+
+		AccessTokenID:        accessToken.ID,
+		AccessTokenExpiresAt: accessToken.ExpiresAt,
+		Scopes:               session.Scopes,
+	}, currentTime)
+	if errors.Is(err, database.ErrTokenReused) {
+		respondWithTokenReused(w, r, session)
+		return
+	}
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusUnauthorized, "Refresh token does not exist")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct {
+		Token        string   `json:"token"`
+		RefreshToken string   `json:"refresh_token"`
+		Scopes       []string `json:"scopes"`
+	}{
+		Token:        signedJwtToken,
+		RefreshToken: newRefreshToken,
+		Scopes:       scopes,
 	})
 
-}
\ No newline at end of file
+}
+
+func respondWithTokenReused(w http.ResponseWriter, r *http.Request, session database.RefreshToken) {
+	log.Printf("security: rotated refresh token reused for user %d session %s from %s; session revoked", session.UserID, session.ID, clientIP(r))
+	respondWithError(w, http.StatusUnauthorized, "Refresh token has already been used")
+}
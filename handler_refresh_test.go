@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/creighbattle/chirpy/database"
+)
+
+type tokenPair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func TestRefreshReuseRevokesSession(t *testing.T) {
+	cfg := newTestConfig(t, database.NewMemoryDB())
+	srv := newTestServer(t, cfg)
+	user := createTestUser(t, cfg, "refresher@example.com")
+
+	login := tokenPair{}
+	code := doRequest(t, srv, "POST", "/api/login", "", map[string]string{"email": user.Email, "password": testPassword}, &login)
+	if code != http.StatusOK {
+		t.Fatalf("login: got %d, want %d", code, http.StatusOK)
+	}
+	rotated := tokenPair{}
+	code = doRequest(t, srv, "POST", "/api/refresh", "Bearer "+login.RefreshToken, nil, &rotated)
+	if code != http.StatusOK {
+		t.Fatalf("refresh: got %d, want %d", code, http.StatusOK)
+	}
+
+	// A replay asking for a scope the session doesn't have is still reuse.
+	code = doRequest(t, srv, "POST", "/api/refresh", "Bearer "+login.RefreshToken, map[string][]string{"scopes": {"admin"}}, nil)
+	if code != http.StatusUnauthorized {
+		t.Fatalf("replay: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	code = doRequest(t, srv, "POST", "/api/refresh", "Bearer "+rotated.RefreshToken, nil, nil)
+	if code != http.StatusUnauthorized {
+		t.Fatalf("refresh after replay: got %d, want %d", code, http.StatusUnauthorized)
+	}
+}
@@ -1,16 +1,25 @@
 package main
 
-import "net/http"
+import (
+	"net/http"
+
+	"github.com/creighbattle/chirpy/auth"
+	"github.com/creighbattle/chirpy/database"
+)
 
 func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
-	refreshToken := r.Header.Get("Authorization")
-	refreshToken = refreshToken[7:]
+	refreshToken, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Refresh token required")
+		return
+	}
 
-	err := cfg.DB.RevokeRefreshToken(refreshToken)
+	err = cfg.DB.RevokeRefreshToken(database.HashToken(refreshToken))
 
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
 	}
 
 	respondWithJSON(w, http.StatusNoContent, struct{}{})
-}
\ No newline at end of file
+}
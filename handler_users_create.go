@@ -2,14 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
 )
 
-
-
 func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
-		Email string `json:"email"`
+		Email    string `json:"email"`
 		Password string `json:"password"`
 	}
 
@@ -21,12 +20,33 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	user, err := cfg.DB.CreateUser(params.Email, params.Password)
-	
+	errs, err := cfg.validateCredentials(params.Email, params.Password)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check password")
+		return
+	}
+	if len(errs) > 0 {
+		respondWithValidationErrors(w, errs)
+		return
+	}
+
+	passwordHash, err := cfg.passwordHasher.Hash(params.Password)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password")
+		return
+	}
+
+	user, err := cfg.DB.CreateUser(params.Email, passwordHash)
+
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	err = cfg.sendVerificationEmail(user.ID, user.Email)
+	if err != nil {
+		log.Printf("Error sending verification email to user %d: %s", user.ID, err)
+	}
+
 	respondWithJSON(w, http.StatusCreated, user)
-}
\ No newline at end of file
+}
@@ -2,21 +2,20 @@ package main
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
-	"strconv"
 
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/creighbattle/chirpy/auth"
 )
 
 func (cfg *apiConfig) handlerUsersUpdate(w http.ResponseWriter, r *http.Request) {
 
-	jwtToken := r.Header.Get("Authorization")
-	jwtToken = jwtToken[7:]
+	userIdInt, _ := auth.UserIDFromContext(r.Context())
 
 	type parameters struct {
-		Email string `json:"email"`
-		Password string `json:"password"`
-		ExpiresInSeconds int `json:"expires_in_seconds"`
+		Email            string `json:"email"`
+		Password         string `json:"password"`
+		ExpiresInSeconds int    `json:"expires_in_seconds"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -27,30 +26,42 @@ func (cfg *apiConfig) handlerUsersUpdate(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-
-	claims := &jwt.RegisteredClaims{}
-	token, err := jwt.ParseWithClaims(jwtToken, claims, func(token *jwt.Token) (interface{}, error) {
-    	return cfg.jwtSecret, nil
-	})
-
+	errs, err := cfg.validateCredentials(params.Email, params.Password)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Invalid token")
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check password")
+		return
+	}
+	if len(errs) > 0 {
+		respondWithValidationErrors(w, errs)
 		return
 	}
 
-	userId, err := token.Claims.GetSubject()
-	userIdInt, _ := strconv.Atoi(userId)
-	
+	passwordHash, err := cfg.passwordHasher.Hash(params.Password)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Subject not found")
+		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password")
 		return
 	}
 
-	res, err := cfg.DB.UpdateUser(params.Email, params.Password, userIdInt)
+	res, err := cfg.DB.UpdateUser(params.Email, passwordHash, userIdInt)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	if !res.EmailVerified {
+		err = cfg.sendVerificationEmail(res.ID, res.Email)
+		if err != nil {
+			log.Printf("Error sending verification email to user %d: %s", res.ID, err)
+		}
+	}
+
+	// A new password must lock out whoever knew the old one, so every session,
+	// the access tokens issued with them and the API keys go.
+	err = cfg.DB.RevokeUserSessions(userIdInt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions")
+		return
+	}
+
 	respondWithJSON(w, http.StatusOK, res)
-}
\ No newline at end of file
+}
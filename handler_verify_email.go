@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/creighbattle/chirpy/auth"
+	"github.com/creighbattle/chirpy/database"
+	"github.com/creighbattle/chirpy/mail"
+)
+
+const emailVerificationTTL = 48 * time.Hour
+
+func (cfg *apiConfig) sendVerificationEmail(userID int, email string) error {
+	token, err := cfg.issueOneTimeToken(userID, email, database.PurposeEmailVerification, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	cfg.sendMail(mail.Message{
+		To:      email,
+		Subject: "Verify your Chirpy email address",
+		Body: fmt.Sprintf("Please confirm this is your email address. Your verification token is\n\n"+
+			"%s\n\n"+
+			"Send it within two days as\n\n"+
+			"POST %s/api/users/verify-email\n"+
+			"{\"token\": \"<verification token>\"}\n\n"+
+			"If you didn't sign up for Chirpy, you can ignore this email.\n",
+			token, cfg.publicURL),
+	})
+	return nil
+}
+
+func (cfg *apiConfig) handlerVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	token, err := cfg.DB.UseOneTimeToken(database.HashToken(params.Token), database.PurposeEmailVerification, time.Now().UTC())
+	if err == nil {
+		err = cfg.DB.SetEmailVerified(token.UserID, token.Email)
+	}
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired verification token")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't verify email")
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, struct{}{})
+}
+
+func (cfg *apiConfig) handlerResendVerification(w http.ResponseWriter, r *http.Request) {
+	userID, _ := auth.UserIDFromContext(r.Context())
+
+	user, err := cfg.DB.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting user")
+		return
+	}
+	if user.EmailVerified {
+		respondWithError(w, http.StatusConflict, "Email is already verified")
+		return
+	}
+
+	err = cfg.sendVerificationEmail(user.ID, user.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't send verification email")
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, struct{}{})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/creighbattle/chirpy/database"
+)
+
+func TestVerifyEmail(t *testing.T) {
+	cfg := newTestConfig(t, database.NewMemoryDB())
+	srv := newTestServer(t, cfg)
+
+	user := database.UserResponse{}
+	code := doRequest(t, srv, "POST", "/api/users", "", map[string]string{"email": "jo@example.com", "password": testPassword}, &user)
+	if code != http.StatusCreated {
+		t.Fatalf("signup: got %d, want %d", code, http.StatusCreated)
+	}
+	token := waitForMailedToken(t, cfg, "verification")
+
+	code = doRequest(t, srv, "POST", "/api/users/verify-email", "", map[string]string{"token": token}, nil)
+	if code != http.StatusNoContent {
+		t.Fatalf("verify: got %d, want %d", code, http.StatusNoContent)
+	}
+	got, err := cfg.DB.GetUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.EmailVerified {
+		t.Fatal("email is not verified")
+	}
+
+	code = doRequest(t, srv, "POST", "/api/users/verify-email", "", map[string]string{"token": token}, nil)
+	if code != http.StatusBadRequest {
+		t.Fatalf("verify with used token: got %d, want %d", code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// backoff locks logins out for base once freeAttempts failures in a row have
+// been made, doubling with every further failure up to max.
+type backoff struct {
+	freeAttempts int
+	base         time.Duration
+	max          time.Duration
+}
+
+var (
+	accountBackoff = backoff{freeAttempts: 5, base: 30 * time.Second, max: time.Hour}
+	// Many users can share an address behind a NAT, so allow more per IP.
+	ipBackoff = backoff{freeAttempts: 20, base: 30 * time.Second, max: time.Hour}
+)
+
+// accountFailureWindow is how long a failed login counts against an email
+// address, whether or not there is an account behind it.
+const accountFailureWindow = 24 * time.Hour
+
+func (b backoff) lockout(failures int) time.Duration {
+	if failures < b.freeAttempts {
+		return 0
+	}
+	doublings := failures - b.freeAttempts
+	if doublings >= 32 {
+		return b.max
+	}
+	d := b.base << doublings
+	if d <= 0 || d > b.max {
+		return b.max
+	}
+	return d
+}
+
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// loginThrottle tracks failed logins in memory for things that aren't
+// accounts: client IPs, and email addresses with no account behind them, so
+// that those get locked out exactly like real ones and a lockout doesn't give
+// away whether an account exists. Failures older than window are forgotten.
+// The same bookkeeping throttles password reset emails, see allow.
+type loginThrottle struct {
+	mu       sync.Mutex
+	policy   backoff
+	window   time.Duration
+	failures map[string]*loginFailures
+}
+
+func newLoginThrottle(policy backoff, window time.Duration) *loginThrottle {
+	return &loginThrottle{policy: policy, window: window, failures: map[string]*loginFailures{}}
+}
+
+// retryAfter is how long key is still locked out for, or 0.
+func (t *loginThrottle) retryAfter(key string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.failures[key]
+	if !ok || !now.Before(f.lockedUntil) {
+		return 0
+	}
+	return f.lockedUntil.Sub(now)
+}
+
+func (t *loginThrottle) fail(key string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.record(key, now)
+}
+
+// allow counts an attempt against key unless it is locked out, and reports
+// whether it did. It throttles actions rather than failures, such as sending
+// password reset emails.
+func (t *loginThrottle) allow(key string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if f, ok := t.failures[key]; ok && now.Before(f.lockedUntil) {
+		return false
+	}
+	t.record(key, now)
+	return true
+}
+
+func (t *loginThrottle) record(key string, now time.Time) {
+	f, ok := t.failures[key]
+	if !ok || now.Sub(f.last) > t.window {
+		f = &loginFailures{}
+		t.failures[key] = f
+	}
+	f.count++
+	f.last = now
+	if d := t.policy.lockout(f.count); d > 0 {
+		f.lockedUntil = now.Add(d)
+	}
+}
+
+// prune drops entries that are neither locked out nor recent enough to count.
+func (t *loginThrottle) prune(now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for key, f := range t.failures {
+		if now.Sub(f.last) > t.window && !now.Before(f.lockedUntil) {
+			delete(t.failures, key)
+			n++
+		}
+	}
+	return n
+}
+
+func pruneLoginThrottle(t *loginThrottle, interval time.Duration) {
+	for range time.Tick(interval) {
+		n := t.prune(time.Now())
+		if n > 0 {
+			log.Printf("Pruned %d stale login throttle entries", n)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Package mail sends the emails chirpy needs, such as password reset links.
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// Open returns the Mailer selected by driver: "outbox" (the default), which
+// writes each email to a file in outboxDir instead of sending it, or "smtp".
+// from is the sender, with or without a display name, such as
+// "Chirpy <no-reply@example.com>".
+func Open(driver string, from string, outboxDir string, smtpConfig SMTPConfig) (Mailer, error) {
+	fromAddr, err := netmail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address %q: %w", from, err)
+	}
+
+	switch driver {
+	case "", "outbox":
+		return &OutboxMailer{Dir: outboxDir, From: *fromAddr}, nil
+	case "smtp":
+		if smtpConfig.Addr == "" {
+			return nil, fmt.Errorf("the smtp mail driver needs SMTP_ADDR")
+		}
+		return &SMTPMailer{Config: smtpConfig, From: *fromAddr}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail driver %q", driver)
+	}
+}
+
+// format renders msg as an RFC 5322 message.
+func format(from netmail.Address, msg Message, date time.Time) []byte {
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, "From: %s\r\n", from.String())
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return buf.Bytes()
+}
+
+// validAddress guards the headers against addresses smuggling in extra lines.
+func validAddress(addr string) error {
+	if addr == "" || strings.ContainsAny(addr, "\r\n") {
+		return fmt.Errorf("invalid email address %q", addr)
+	}
+	return nil
+}
+
+// OutboxMailer writes every email to Dir as a .eml file, for development and
+// for running without a mail server.
+type OutboxMailer struct {
+	Dir  string
+	From netmail.Address
+}
+
+func (m *OutboxMailer) Send(msg Message) error {
+	err := validAddress(msg.To)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(m.Dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%s-%s.eml", now.UTC().Format("20060102T150405.000000000Z"), hex.EncodeToString(suffix))
+	return os.WriteFile(filepath.Join(m.Dir, name), format(m.From, msg, now), 0600)
+}
+
+type SMTPConfig struct {
+	// Addr is the server's host:port.
+	Addr     string
+	Username string
+	Password string
+}
+
+// SMTPMailer sends email through an SMTP server, authenticating with PLAIN
+// auth if a username is set. net/smtp upgrades to TLS when the server offers
+// STARTTLS and refuses to send credentials over an unencrypted connection to
+// anything but localhost.
+type SMTPMailer struct {
+	Config SMTPConfig
+	// From's display name only goes in the header; the envelope takes the
+	// bare address.
+	From netmail.Address
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	err := validAddress(msg.To)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.Config.Username != "" {
+		host, _, err := net.SplitHostPort(m.Config.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Config.Username, m.Config.Password, host)
+	}
+	return smtp.SendMail(m.Config.Addr, auth, m.From.Address, []string{msg.To}, format(m.From, msg, time.Now()))
+}
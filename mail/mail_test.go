@@ -0,0 +1,109 @@
+package mail
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeSMTP accepts one message and sends the commands and data it received
+// on the returned channel.
+func fakeSMTP(t *testing.T) (addr string, received <-chan []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	lines := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		got := []string{}
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 fake ESMTP")
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			line = strings.TrimRight(line, "\r\n")
+			got = append(got, line)
+			if inData {
+				if line == "." {
+					inData = false
+					reply("250 OK")
+				}
+				continue
+			}
+			switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); {
+			case cmd == "EHLO" || cmd == "HELO":
+				reply("250 fake")
+			case strings.HasPrefix(cmd, "MAIL") || strings.HasPrefix(cmd, "RCPT"):
+				// Like real servers, refuse anything but a bare address.
+				_, path, _ := strings.Cut(line, ":")
+				if strings.Count(path, "<") != 1 || strings.ContainsAny(strings.Trim(path, "<>"), " <>") {
+					reply("501 bad address")
+					continue
+				}
+				reply("250 OK")
+			case cmd == "DATA":
+				inData = true
+				reply("354 go ahead")
+			case cmd == "QUIT":
+				reply("221 bye")
+				lines <- got
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+		lines <- got
+	}()
+	return ln.Addr().String(), lines
+}
+
+func TestSMTPMailerSenderWithDisplayName(t *testing.T) {
+	addr, received := fakeSMTP(t)
+	mailer, err := Open("smtp", "Chirpy <no-reply@example.com>", "", SMTPConfig{Addr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mailer.Send(Message{To: "jo@example.com", Subject: "Hello", Body: "Hi Jo\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := <-received
+	for _, want := range []string{
+		"MAIL FROM:<no-reply@example.com>",
+		"RCPT TO:<jo@example.com>",
+		`From: "Chirpy" <no-reply@example.com>`,
+	} {
+		found := false
+		for _, line := range lines {
+			if strings.HasPrefix(line, want) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no %q in session:\n%s", want, strings.Join(lines, "\n"))
+		}
+	}
+}
+
+func TestOpenRejectsInvalidSender(t *testing.T) {
+	_, err := Open("smtp", "Chirpy no-reply", "", SMTPConfig{Addr: "localhost:25"})
+	if err == nil {
+		t.Fatal("got no error")
+	}
+}
@@ -1,66 +1,361 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/creighbattle/chirpy/auth"
 	"github.com/creighbattle/chirpy/database"
+	"github.com/creighbattle/chirpy/mail"
+	"github.com/creighbattle/chirpy/oidc"
 	"github.com/joho/godotenv"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type apiConfig struct {
 	fileserverHits int
-	DB *database.DB
-	jwtSecret []byte
-	polkaKey string
+	DB             database.Store
+	jwtKeys        *auth.KeySet
+	polkaKey       string
+	adminKey       string
+	mailer         mail.Mailer
+	publicURL      string
+	// requireVerifiedEmail stops users who haven't verified their email
+	// address from posting chirps.
+	requireVerifiedEmail bool
+	ipThrottle           *loginThrottle
+	emailThrottle        *loginThrottle
+	resetIPThrottle      *loginThrottle
+	resetEmailThrottle   *loginThrottle
+	passwordPolicy       auth.PasswordPolicy
+	passwordHasher       auth.PasswordHasher
+	// dummyPasswordHash is checked when logging in as a user who doesn't
+	// exist, so that takes as long as for one who does.
+	dummyPasswordHash string
+	oidcProviders     map[string]*oidc.Provider
 }
 
-
 func main() {
 	godotenv.Load()
 	jwtSecret := os.Getenv("JWT_SECRET")
+	jwtKeyDir := os.Getenv("JWT_KEY_DIR")
 	polkaKey := os.Getenv("POLKA_KEY")
+	adminKey := os.Getenv("ADMIN_KEY")
+	dbDriver := os.Getenv("DB_DRIVER")
+	dbPath := os.Getenv("DB_PATH")
+	publicURL := os.Getenv("PUBLIC_URL")
+	mailFrom := os.Getenv("MAIL_FROM")
+	mailOutbox := os.Getenv("MAIL_OUTBOX_DIR")
 	const filepathRoot = "."
 	const port = "8080"
 
-	db, err := database.NewDB("database.json")
+	if dbPath == "" {
+		dbPath = "database.json"
+		if dbDriver == "sqlite" {
+			dbPath = "database.sqlite"
+		}
+	}
+
+	if publicURL == "" {
+		publicURL = "http://localhost:" + port
+	}
+	if mailFrom == "" {
+		mailFrom = "Chirpy <no-reply@localhost>"
+	}
+	if mailOutbox == "" {
+		mailOutbox = "outbox"
+	}
+
+	if len(os.Args) > 1 {
+		err := runCommand(os.Args[1], os.Args[2:], commandEnv{
+			dbDriver: dbDriver,
+			dbPath:   dbPath,
+			adminKey: adminKey,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	dbOpts := []database.Option{}
+	if os.Getenv("DB_RELOAD_ON_CHANGE") == "true" {
+		dbOpts = append(dbOpts, database.WithReloadOnChange())
+	}
+
+	db, err := database.Open(dbDriver, dbPath, dbOpts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var jwtKeys *auth.KeySet
+	if jwtKeyDir != "" {
+		var secret []byte
+		if jwtSecret != "" {
+			secret = []byte(jwtSecret)
+		}
+		jwtKeys, err = auth.LoadKeyDir(jwtKeyDir, secret)
+	} else {
+		jwtKeys, err = auth.NewHMACKeySet([]byte(jwtSecret))
+	}
+	if err != nil {
+		log.Fatalf("Set JWT_KEY_DIR or JWT_SECRET: %s", err)
+	}
+
+	passwordPolicy, err := loadPasswordPolicy()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	passwordHasher, err := loadPasswordHasher()
+	if err != nil {
+		log.Fatal(err)
+	}
+	dummyPasswordHash, err := passwordHasher.Hash("not a real password")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	oidcProviders, err := loadOIDCProviders(strings.TrimSuffix(publicURL, "/"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mailer, err := mail.Open(os.Getenv("MAIL_DRIVER"), mailFrom, mailOutbox, mail.SMTPConfig{
+		Addr:     os.Getenv("SMTP_ADDR"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	apiCfg := apiConfig{
 		fileserverHits: 0,
-		DB: db,
-		jwtSecret: []byte(jwtSecret),
-		polkaKey: polkaKey,
+		DB:             db,
+		jwtKeys:        jwtKeys,
+		polkaKey:       polkaKey,
+		adminKey:       adminKey,
+		mailer:         mailer,
+		publicURL:      strings.TrimSuffix(publicURL, "/"),
+
+		requireVerifiedEmail: os.Getenv("REQUIRE_VERIFIED_EMAIL") == "true",
+		ipThrottle:           newLoginThrottle(ipBackoff, time.Hour),
+		emailThrottle:        newLoginThrottle(accountBackoff, accountFailureWindow),
+		resetIPThrottle:      newLoginThrottle(resetIPBackoff, time.Hour),
+		resetEmailThrottle:   newLoginThrottle(resetEmailBackoff, passwordResetTTL),
+		passwordPolicy:       passwordPolicy,
+		passwordHasher:       passwordHasher,
+		dummyPasswordHash:    dummyPasswordHash,
+		oidcProviders:        oidcProviders,
+	}
+
+	go pruneExpiredTokens(db, time.Hour)
+	go pruneLoginThrottle(apiCfg.ipThrottle, 10*time.Minute)
+	go pruneLoginThrottle(apiCfg.emailThrottle, 10*time.Minute)
+	go pruneLoginThrottle(apiCfg.resetIPThrottle, 10*time.Minute)
+	go pruneLoginThrottle(apiCfg.resetEmailThrottle, 10*time.Minute)
+
+	srv := &http.Server{
+		Addr:    ":" + port,
+		Handler: apiCfg.routes(filepathRoot),
+	}
+
+	log.Printf("Serving files from %s on port: %s\n", filepathRoot, port)
+	log.Fatal(srv.ListenAndServe())
+}
+
+// routes serves the API, the admin endpoints and the files in filepathRoot.
+func (cfg *apiConfig) routes(filepathRoot string) http.Handler {
+	requireUser := auth.RequireUser(cfg.jwtKeys, cfg.DB, cfg.verifyAPIKey)
+	// Every authenticated route names the scope it needs; access tokens and
+	// API keys without it get 403.
+	requireScope := func(scope string, handler http.HandlerFunc) http.Handler {
+		return requireUser(auth.RequireScope(scope)(handler))
 	}
 
 	mux := http.NewServeMux()
-	fsHandler := apiCfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot))))
+	fsHandler := cfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot))))
 	mux.Handle("/app/*", fsHandler)
 
+	mux.HandleFunc("GET /.well-known/jwks.json", cfg.handlerJWKS)
 	mux.HandleFunc("GET /api/healthz", handlerReadiness)
-	mux.HandleFunc("GET /api/reset", apiCfg.handlerReset)
-	mux.HandleFunc("POST /api/chirps", apiCfg.handlerChirpsCreate)
-	mux.HandleFunc("GET /api/chirps", apiCfg.handlerChirpsRetrieve)
-	mux.HandleFunc("GET /api/chirps/{chirpID}", apiCfg.handlerChripRetrieve)
-	mux.HandleFunc("POST /api/users", apiCfg.handlerUsersCreate)
-	mux.HandleFunc("PUT /api/users", apiCfg.handlerUsersUpdate)
-	mux.HandleFunc("POST /api/login", apiCfg.handlerLogin)
-	mux.HandleFunc("POST /api/refresh", apiCfg.handlerRefresh)
-	mux.HandleFunc("POST /api/revoke", apiCfg.handlerRevoke)
-	mux.HandleFunc("POST /api/polka/webhooks", apiCfg.handlerPolkaWebhook)
-	mux.HandleFunc("DELETE /api/chirps/{chirpID}", apiCfg.handlerDeleteChirp)
-
-	mux.HandleFunc("GET /admin/metrics", apiCfg.handlerMetrics)
+	mux.HandleFunc("GET /api/reset", cfg.handlerReset)
+	mux.Handle("POST /api/chirps", requireScope(auth.ScopeChirpsWrite, cfg.handlerChirpsCreate))
+	mux.HandleFunc("GET /api/chirps", cfg.handlerChirpsRetrieve)
+	mux.HandleFunc("GET /api/chirps/{chirpID}", cfg.handlerChripRetrieve)
+	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	mux.Handle("PUT /api/users", requireScope(auth.ScopeAccount, cfg.handlerUsersUpdate))
+	mux.HandleFunc("POST /api/users/verify-email", cfg.handlerVerifyEmail)
+	mux.Handle("POST /api/users/verify-email/resend", requireScope(auth.ScopeAccount, cfg.handlerResendVerification))
+	mux.Handle("POST /api/users/2fa/setup", requireScope(auth.ScopeAccount, cfg.handlerTOTPSetup))
+	mux.Handle("POST /api/users/2fa/confirm", requireScope(auth.ScopeAccount, cfg.handlerTOTPConfirm))
+	mux.Handle("POST /api/users/2fa/disable", requireScope(auth.ScopeAccount, cfg.handlerTOTPDisable))
+	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
+	mux.HandleFunc("POST /api/login/2fa", cfg.handlerLogin2FA)
+	mux.HandleFunc("GET /api/auth/{provider}/start", cfg.handlerOIDCStart)
+	mux.HandleFunc("GET /api/auth/{provider}/callback", cfg.handlerOIDCCallback)
+	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
+	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
+	mux.HandleFunc("POST /api/password-reset/request", cfg.handlerPasswordResetRequest)
+	mux.HandleFunc("POST /api/password-reset/confirm", cfg.handlerPasswordResetConfirm)
+	mux.HandleFunc("POST /api/polka/webhooks", cfg.handlerPolkaWebhook)
+	mux.Handle("DELETE /api/chirps/{chirpID}", requireScope(auth.ScopeChirpsWrite, cfg.handlerDeleteChirp))
+	mux.Handle("GET /api/sessions", requireScope(auth.ScopeAccount, cfg.handlerSessionsList))
+	mux.Handle("DELETE /api/sessions/{sessionID}", requireScope(auth.ScopeAccount, cfg.handlerSessionDelete))
+	mux.Handle("POST /api/logout-all", requireScope(auth.ScopeAccount, cfg.handlerLogoutAll))
+	mux.Handle("POST /api/keys", requireScope(auth.ScopeAccount, cfg.handlerAPIKeysCreate))
+	mux.Handle("GET /api/keys", requireScope(auth.ScopeAccount, cfg.handlerAPIKeysList))
+	mux.Handle("DELETE /api/keys/{keyID}", requireScope(auth.ScopeAccount, cfg.handlerAPIKeyDelete))
 
-	srv := &http.Server{
-		Addr:   ":" + port,
-		Handler: mux,
+	mux.HandleFunc("GET /admin/metrics", cfg.handlerMetrics)
+	mux.HandleFunc("GET /admin/backup", cfg.handlerBackup)
+	mux.HandleFunc("POST /admin/restore", cfg.handlerRestore)
+	mux.HandleFunc("POST /admin/users/{userID}/unlock", cfg.handlerUnlockUser)
+	return mux
+}
+
+// loadPasswordPolicy reads PASSWORD_MIN_LENGTH, PASSWORD_MIN_SCORE (0-4) and
+// BREACHED_PASSWORDS_FILE, a sorted Pwned Passwords SHA-1 list, on top of
+// the defaults.
+func loadPasswordPolicy() (auth.PasswordPolicy, error) {
+	policy := auth.DefaultPasswordPolicy()
+
+	if v := os.Getenv("PASSWORD_MIN_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return policy, fmt.Errorf("invalid PASSWORD_MIN_LENGTH %q", v)
+		}
+		policy.MinLength = n
+	}
+	if v := os.Getenv("PASSWORD_MIN_SCORE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 4 {
+			return policy, fmt.Errorf("invalid PASSWORD_MIN_SCORE %q, want 0 to 4", v)
+		}
+		policy.MinScore = n
 	}
+	if path := os.Getenv("BREACHED_PASSWORDS_FILE"); path != "" {
+		breaches, err := auth.OpenBreachFile(path)
+		if err != nil {
+			return policy, err
+		}
+		policy.Breaches = breaches
+	}
+	return policy, nil
+}
 
-	log.Printf("Serving files from %s on port: %s\n", filepathRoot, port)
-	log.Fatal(srv.ListenAndServe())
+// loadPasswordHasher reads PASSWORD_HASH, "argon2id" (the default) or
+// "bcrypt", and its parameters: ARGON2_MEMORY_KIB, ARGON2_ITERATIONS and
+// ARGON2_PARALLELISM, or BCRYPT_COST. Existing hashes made differently, or
+// with lower parameters, are replaced as their users log in.
+func loadPasswordHasher() (auth.PasswordHasher, error) {
+	switch algorithm := os.Getenv("PASSWORD_HASH"); algorithm {
+	case "", "argon2id":
+		hasher := auth.DefaultArgon2idHasher()
+		for _, param := range []struct {
+			env   string
+			value *uint32
+			max   uint32
+		}{
+			{"ARGON2_MEMORY_KIB", &hasher.Memory, 1 << 22},
+			{"ARGON2_ITERATIONS", &hasher.Iterations, 100},
+		} {
+			if v := os.Getenv(param.env); v != "" {
+				n, err := strconv.ParseUint(v, 10, 32)
+				if err != nil || n < 1 || uint32(n) > param.max {
+					return nil, fmt.Errorf("invalid %s %q", param.env, v)
+				}
+				*param.value = uint32(n)
+			}
+		}
+		if v := os.Getenv("ARGON2_PARALLELISM"); v != "" {
+			n, err := strconv.ParseUint(v, 10, 8)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid ARGON2_PARALLELISM %q", v)
+			}
+			hasher.Parallelism = uint8(n)
+		}
+		return hasher, nil
+	case "bcrypt":
+		hasher := auth.BcryptHasher{Cost: 12}
+		if v := os.Getenv("BCRYPT_COST"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < bcrypt.MinCost || n > bcrypt.MaxCost {
+				return nil, fmt.Errorf("invalid BCRYPT_COST %q", v)
+			}
+			hasher.Cost = n
+		}
+		return hasher, nil
+	default:
+		return nil, fmt.Errorf("unknown PASSWORD_HASH %q, want argon2id or bcrypt", algorithm)
+	}
 }
 
+// loadOIDCProviders reads the comma-separated OIDC_PROVIDERS, and for each
+// provider NAME in it OIDC_NAME_ISSUER, OIDC_NAME_CLIENT_ID,
+// OIDC_NAME_CLIENT_SECRET and optionally OIDC_NAME_SCOPES (space-separated,
+// "openid email" by default). Register <PUBLIC_URL>/api/auth/<name>/callback
+// as the redirect URL with the provider.
+func loadOIDCProviders(publicURL string) (map[string]*oidc.Provider, error) {
+	providers := map[string]*oidc.Provider{}
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if strings.Trim(name, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+			return nil, fmt.Errorf("invalid OIDC provider name %q, use lower case letters, digits and dashes", name)
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		provider := &oidc.Provider{
+			Name:         name,
+			IssuerURL:    os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  publicURL + "/api/auth/" + name + "/callback",
+			Scopes:       strings.Fields(os.Getenv(prefix + "SCOPES")),
+		}
+		if provider.IssuerURL == "" || provider.ClientID == "" {
+			return nil, fmt.Errorf("OIDC provider %s needs %sISSUER and %sCLIENT_ID", name, prefix, prefix)
+		}
+		if len(provider.Scopes) == 0 {
+			provider.Scopes = []string{"openid", "email"}
+		}
+		providers[name] = provider
+	}
+	return providers, nil
+}
+
+// pruneExpiredTokens drops denylist entries for access tokens that have
+// expired anyway, and one-time tokens past their expiry, every interval.
+func pruneExpiredTokens(db database.Store, interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := db.DeleteExpiredRevokedTokens(time.Now())
+		if err != nil {
+			log.Printf("Error pruning revoked tokens: %s", err)
+		} else if n > 0 {
+			log.Printf("Pruned %d expired revoked tokens", n)
+		}
+
+		n, err = db.DeleteExpiredRefreshTokens(time.Now())
+		if err != nil {
+			log.Printf("Error pruning refresh tokens: %s", err)
+		} else if n > 0 {
+			log.Printf("Pruned %d expired refresh tokens", n)
+		}
+
+		n, err = db.DeleteExpiredOneTimeTokens(time.Now())
+		if err != nil {
+			log.Printf("Error pruning one-time tokens: %s", err)
+		} else if n > 0 {
+			log.Printf("Pruned %d expired one-time tokens", n)
+		}
+	}
+}
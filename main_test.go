@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	netmail "net/mail"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/creighbattle/chirpy/auth"
+	"github.com/creighbattle/chirpy/database"
+	"github.com/creighbattle/chirpy/mail"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testPassword = "violet-kayak-47"
+
+// newTestConfig returns a config like main's, with cheap password hashing
+// and mail written to an outbox in a temporary directory.
+func newTestConfig(t *testing.T, db database.Store) *apiConfig {
+	t.Helper()
+	hasher := auth.BcryptHasher{Cost: bcrypt.MinCost}
+	dummyPasswordHash, err := hasher.Hash("not a real password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwtKeys, err := auth.NewHMACKeySet([]byte("test secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &apiConfig{
+		DB:                 db,
+		jwtKeys:            jwtKeys,
+		adminKey:           "test admin key",
+		mailer:             &mail.OutboxMailer{Dir: filepath.Join(t.TempDir(), "outbox"), From: netmail.Address{Name: "Chirpy", Address: "no-reply@localhost"}},
+		publicURL:          "http://chirpy.test",
+		ipThrottle:         newLoginThrottle(ipBackoff, time.Hour),
+		emailThrottle:      newLoginThrottle(accountBackoff, accountFailureWindow),
+		resetIPThrottle:    newLoginThrottle(resetIPBackoff, time.Hour),
+		resetEmailThrottle: newLoginThrottle(resetEmailBackoff, passwordResetTTL),
+		passwordPolicy:     auth.DefaultPasswordPolicy(),
+		passwordHasher:     hasher,
+		dummyPasswordHash:  dummyPasswordHash,
+	}
+}
+
+func newTestServer(t *testing.T, cfg *apiConfig) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(cfg.routes(t.TempDir()))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func createTestUser(t *testing.T, cfg *apiConfig, email string) database.UserResponse {
+	t.Helper()
+	hash, err := cfg.passwordHasher.Hash(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := cfg.DB.CreateUser(email, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// testToken returns an "Authorization" header value with an access token
+// for the user, good for every scope unless scopes are given.
+func testToken(t *testing.T, cfg *apiConfig, userID int, scopes ...string) string {
+	t.Helper()
+	if len(scopes) == 0 {
+		scopes = auth.AllScopes
+	}
+	token, _, err := auth.MakeJWT(userID, scopes, cfg.jwtKeys, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + token
+}
+
+// doRequest sends body, if not nil, as JSON and decodes a JSON response into
+// out, if not nil. It returns the status code.
+func doRequest(t *testing.T, srv *httptest.Server, method string, path string, authorization string, body any, out any) int {
+	t.Helper()
+	var reqBody io.Reader
+	if body != nil {
+		dat, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqBody = bytes.NewReader(dat)
+	}
+	req, err := http.NewRequest(method, srv.URL+path, reqBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	dat, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != nil && len(dat) > 0 {
+		err = json.Unmarshal(dat, out)
+		if err != nil {
+			t.Fatalf("%s %s: decoding %q: %s", method, path, dat, err)
+		}
+	}
+	return resp.StatusCode
+}
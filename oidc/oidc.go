@@ -0,0 +1,260 @@
+// Package oidc logs users in through an OpenID Connect provider, such as a
+// company's single sign-on, with the authorization code flow and PKCE.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// maxResponseBytes caps what is read from the provider.
+const maxResponseBytes = 1 << 20
+
+var ErrInvalidIDToken = errors.New("invalid ID token")
+
+// Provider is one OpenID Connect provider. Its endpoints and keys are
+// discovered from IssuerURL the first time they are needed.
+type Provider struct {
+	Name         string
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the callback registered with the provider.
+	RedirectURL string
+	Scopes      []string
+	// HTTPClient makes every request to the provider; nil means a default
+	// client with a timeout.
+	HTTPClient *http.Client
+
+	mu            sync.Mutex
+	config        *discovery
+	keys          map[string]any
+	keysFetchedAt time.Time
+}
+
+type discovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// Claims is what a verified ID token says about the user. Subject is the
+// provider's stable ID for them.
+type Claims struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+func (p *Provider) client() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+	return defaultClient
+}
+
+// RandomString returns a URL-safe random string, for states and nonces.
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// NewPKCE returns a PKCE code verifier and its S256 challenge (RFC 7636).
+func NewPKCE() (verifier string, challenge string, err error) {
+	verifier, err = RandomString()
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// AuthCodeURL is where to send the user to log in at the provider.
+func (p *Provider) AuthCodeURL(ctx context.Context, state string, nonce string, codeChallenge string) (string, error) {
+	config, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	authURL, err := url.Parse(config.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("bad authorization endpoint: %w", err)
+	}
+	scopes := p.Scopes
+	if !slices.Contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+	q := authURL.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", p.RedirectURL)
+	q.Set("scope", strings.Join(scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", codeChallenge)
+	q.Set("code_challenge_method", "S256")
+	authURL.RawQuery = q.Encode()
+	return authURL.String(), nil
+}
+
+// Exchange trades the code the provider redirected back with for an ID
+// token, verifies it, including that it carries nonce, and returns its
+// claims.
+func (p *Provider) Exchange(ctx context.Context, code string, codeVerifier string, nonce string) (Claims, error) {
+	config, err := p.discover(ctx)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("code_verifier", codeVerifier)
+	form.Set("client_id", p.ClientID)
+
+	// client_secret_basic is the default; some providers only take the
+	// secret in the form.
+	basicAuth := len(config.TokenEndpointAuthMethodsSupported) == 0 ||
+		slices.Contains(config.TokenEndpointAuthMethodsSupported, "client_secret_basic")
+	if p.ClientSecret != "" && !basicAuth {
+		form.Set("client_secret", p.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Claims{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" && basicAuth {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = p.do(req, &token)
+	if err != nil && token.Error == "" {
+		return Claims{}, fmt.Errorf("exchanging code: %w", err)
+	}
+	if token.Error != "" {
+		return Claims{}, fmt.Errorf("exchanging code: %s: %s", token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return Claims{}, errors.New("exchanging code: no id_token in response")
+	}
+
+	return p.verify(ctx, config, token.IDToken, nonce)
+}
+
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce           string          `json:"nonce"`
+	AuthorizedParty string          `json:"azp"`
+	Email           string          `json:"email"`
+	EmailVerified   json.RawMessage `json:"email_verified"`
+}
+
+func (p *Provider) verify(ctx context.Context, config *discovery, idToken string, nonce string) (Claims, error) {
+	claims := &idTokenClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims,
+		func(token *jwt.Token) (interface{}, error) {
+			return p.key(ctx, config, token)
+		},
+		jwt.WithIssuer(config.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: %w", ErrInvalidIDToken, err)
+	}
+
+	if claims.Subject == "" {
+		return Claims{}, fmt.Errorf("%w: no subject", ErrInvalidIDToken)
+	}
+	if nonce == "" || claims.Nonce != nonce {
+		return Claims{}, fmt.Errorf("%w: nonce does not match", ErrInvalidIDToken)
+	}
+	// With several audiences, azp says which client the token is for.
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID {
+		return Claims{}, fmt.Errorf("%w: issued to %q", ErrInvalidIDToken, claims.AuthorizedParty)
+	}
+
+	// Some providers send email_verified as the string "true".
+	verified := strings.Trim(string(claims.EmailVerified), `"`) == "true"
+	return Claims{Subject: claims.Subject, Email: claims.Email, EmailVerified: verified}, nil
+}
+
+// discover fetches the provider's configuration once, and retries on later
+// calls if that failed.
+func (p *Provider) discover(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.config != nil {
+		return p.config, nil
+	}
+
+	issuer := strings.TrimSuffix(p.IssuerURL, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	config := &discovery{}
+	err = p.do(req, config)
+	if err != nil {
+		return nil, fmt.Errorf("discovering %s: %w", p.Name, err)
+	}
+	if strings.TrimSuffix(config.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovering %s: issuer is %q, not %q", p.Name, config.Issuer, p.IssuerURL)
+	}
+	if config.AuthorizationEndpoint == "" || config.TokenEndpoint == "" || config.JWKSURI == "" {
+		return nil, fmt.Errorf("discovering %s: configuration is missing endpoints", p.Name)
+	}
+
+	p.config = config
+	return config, nil
+}
+
+// do sends req and decodes the JSON response into v, which is filled in even
+// for an error status since OAuth errors come as JSON too.
+func (p *Provider) do(req *http.Request, v any) error {
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decodeErr := json.NewDecoder(io.LimitReader(resp.Body, maxResponseBytes)).Decode(v)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL, resp.Status)
+	}
+	return decodeErr
+}
@@ -0,0 +1,91 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/creighbattle/chirpy/oidc/oidctest"
+)
+
+func newTestProvider(t *testing.T) (*Provider, *oidctest.Issuer) {
+	t.Helper()
+	iss := oidctest.NewIssuer(t, "chirpy")
+	iss.SetUser(oidctest.User{Subject: "alice", Email: "alice@example.com", EmailVerified: true})
+	p := &Provider{
+		Name:        "test",
+		IssuerURL:   iss.URL,
+		ClientID:    "chirpy",
+		RedirectURL: "http://chirpy.test/api/auth/test/callback",
+	}
+	return p, iss
+}
+
+// login logs in at iss and exchanges the code with the given verifier and
+// nonce.
+func login(t *testing.T, p *Provider, iss *oidctest.Issuer, codeVerifier string, nonce string) (Claims, error) {
+	t.Helper()
+	verifier, challenge, err := NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codeVerifier == "" {
+		codeVerifier = verifier
+	}
+	code := iss.Authorize("nonce", challenge)
+	return p.Exchange(context.Background(), code, codeVerifier, nonce)
+}
+
+func TestExchange(t *testing.T) {
+	p, iss := newTestProvider(t)
+
+	claims, err := login(t, p, iss, "", "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Claims{Subject: "alice", Email: "alice@example.com", EmailVerified: true}
+	if claims != want {
+		t.Fatalf("got %+v, want %+v", claims, want)
+	}
+
+	_, err = login(t, p, iss, "", "another nonce")
+	if !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("wrong nonce: got %v, want ErrInvalidIDToken", err)
+	}
+
+	_, err = login(t, p, iss, "wrong verifier", "nonce")
+	if err == nil {
+		t.Fatal("wrong code verifier: got no error")
+	}
+}
+
+func TestExchangeRefetchesRotatedKeys(t *testing.T) {
+	p, iss := newTestProvider(t)
+
+	_, err := login(t, p, iss, "", "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss.RotateKey()
+
+	// Too soon after the last fetch to fetch again.
+	_, err = login(t, p, iss, "", "nonce")
+	if !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("right after rotating: got %v, want ErrInvalidIDToken", err)
+	}
+	if n := iss.KeysRequests(); n != 1 {
+		t.Fatalf("keys fetched %d times, want 1", n)
+	}
+
+	p.mu.Lock()
+	p.keysFetchedAt = time.Now().Add(-minKeyRefresh)
+	p.mu.Unlock()
+	_, err = login(t, p, iss, "", "nonce")
+	if err != nil {
+		t.Fatalf("after rotating: %s", err)
+	}
+	if n := iss.KeysRequests(); n != 2 {
+		t.Fatalf("keys fetched %d times, want 2", n)
+	}
+}
@@ -0,0 +1,194 @@
+// Package oidctest runs a fake OpenID Connect provider for tests. It serves
+// discovery, an authorization endpoint that logs in whoever Issuer.User is
+// without asking, a token endpoint that checks PKCE, and its keys.
+package oidctest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// User is who logs in at the provider.
+type User struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+type authRequest struct {
+	user          User
+	nonce         string
+	codeChallenge string
+}
+
+type Issuer struct {
+	*httptest.Server
+	ClientID string
+
+	mu           sync.Mutex
+	user         User
+	kid          string
+	key          ed25519.PrivateKey
+	codes        map[string]authRequest
+	keysRequests int
+}
+
+// NewIssuer starts a provider for clientID, closed when the test ends.
+func NewIssuer(t *testing.T, clientID string) *Issuer {
+	t.Helper()
+	iss := &Issuer{ClientID: clientID, codes: map[string]authRequest{}}
+	iss.RotateKey()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", iss.handleDiscovery)
+	mux.HandleFunc("GET /authorize", iss.handleAuthorize)
+	mux.HandleFunc("POST /token", iss.handleToken)
+	mux.HandleFunc("GET /keys", iss.handleKeys)
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+// SetUser sets who logs in from now on.
+func (iss *Issuer) SetUser(user User) {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	iss.user = user
+}
+
+// RotateKey replaces the signing key with a new one with a new kid, and
+// stops publishing the old one.
+func (iss *Issuer) RotateKey() {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	iss.key = key
+	iss.kid = randomString()
+}
+
+// KeysRequests is how often the keys have been fetched.
+func (iss *Issuer) KeysRequests() int {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	return iss.keysRequests
+}
+
+// Authorize logs the current user in and returns the code the provider
+// would redirect back with.
+func (iss *Issuer) Authorize(nonce string, codeChallenge string) string {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	code := randomString()
+	iss.codes[code] = authRequest{user: iss.user, nonce: nonce, codeChallenge: codeChallenge}
+	return code
+}
+
+func (iss *Issuer) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                 iss.URL,
+		"authorization_endpoint": iss.URL + "/authorize",
+		"token_endpoint":         iss.URL + "/token",
+		"jwks_uri":               iss.URL + "/keys",
+	})
+}
+
+func (iss *Issuer) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != iss.ClientID || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "bad redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	code := iss.Authorize(query.Get("nonce"), query.Get("code_challenge"))
+	q := redirect.Query()
+	q.Set("code", code)
+	q.Set("state", query.Get("state"))
+	redirect.RawQuery = q.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (iss *Issuer) handleToken(w http.ResponseWriter, r *http.Request) {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+
+	req, ok := iss.codes[r.PostFormValue("code")]
+	delete(iss.codes, r.PostFormValue("code"))
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "unknown code"})
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != req.codeChallenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "code verifier does not match"})
+		return
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{
+		"iss":            iss.URL,
+		"aud":            iss.ClientID,
+		"sub":            req.user.Subject,
+		"email":          req.user.Email,
+		"email_verified": req.user.EmailVerified,
+		"nonce":          req.nonce,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	})
+	token.Header["kid"] = iss.kid
+	idToken, err := token.SignedString(iss.key)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"id_token": idToken, "token_type": "Bearer"})
+}
+
+func (iss *Issuer) handleKeys(w http.ResponseWriter, r *http.Request) {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	iss.keysRequests++
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"kid": iss.kid,
+			"use": "sig",
+			"x":   base64.RawURLEncoding.EncodeToString(iss.key.Public().(ed25519.PublicKey)),
+		}},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
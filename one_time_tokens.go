@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/creighbattle/chirpy/database"
+	"github.com/creighbattle/chirpy/mail"
+)
+
+// issueOneTimeToken stores a new one-time token for the user's email and
+// returns the secret to mail them.
+func (cfg *apiConfig) issueOneTimeToken(userID int, email string, purpose string, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	now := time.Now().UTC()
+	err = cfg.DB.CreateOneTimeToken(database.OneTimeToken{
+		TokenHash: database.HashToken(token),
+		UserID:    userID,
+		Email:     email,
+		Purpose:   purpose,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// sendMail sends msg in the background so a slow mail server doesn't hold up
+// the request, and so response times don't reveal whether a mail was sent.
+func (cfg *apiConfig) sendMail(msg mail.Message) {
+	go func() {
+		err := cfg.mailer.Send(msg)
+		if err != nil {
+			log.Printf("Error sending %q email: %s", msg.Subject, err)
+		}
+	}()
+}
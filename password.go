@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+
+	"github.com/creighbattle/chirpy/database"
+)
+
+// checkPassword reports whether password is user's. With no user it checks
+// against a dummy hash instead, so that takes just as long. A correct
+// password whose hash is weaker than the current settings is rehashed.
+func (cfg *apiConfig) checkPassword(user *database.User, password string) bool {
+	if user == nil {
+		cfg.passwordHasher.Verify(password, cfg.dummyPasswordHash)
+		return false
+	}
+
+	match, needsRehash, err := cfg.passwordHasher.Verify(password, user.Password)
+	if err != nil {
+		log.Printf("Error checking password of user %d: %s", user.ID, err)
+		return false
+	}
+	if !match || !needsRehash {
+		return match
+	}
+
+	hash, err := cfg.passwordHasher.Hash(password)
+	if err != nil {
+		log.Printf("Error rehashing password of user %d: %s", user.ID, err)
+		return true
+	}
+	err = cfg.DB.ReplacePasswordHash(user.ID, user.Password, hash)
+	if err != nil {
+		log.Printf("Error rehashing password of user %d: %s", user.ID, err)
+		return true
+	}
+	user.Password = hash
+	return true
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/creighbattle/chirpy/auth"
+	"github.com/creighbattle/chirpy/database"
+)
+
+func TestRoutesRequireScopes(t *testing.T) {
+	cfg := newTestConfig(t, database.NewMemoryDB())
+	srv := newTestServer(t, cfg)
+	user := createTestUser(t, cfg, "scoped@example.com")
+	tokens := map[string]string{
+		auth.ScopeChirpsWrite: testToken(t, cfg, user.ID, auth.ScopeAccount),
+		auth.ScopeAccount:     testToken(t, cfg, user.ID, auth.ScopeChirpsWrite),
+	}
+
+	for _, route := range []struct {
+		method string
+		path   string
+		scope  string
+	}{
+		{"POST", "/api/chirps", auth.ScopeChirpsWrite},
+		{"DELETE", "/api/chirps/1", auth.ScopeChirpsWrite},
+		{"PUT", "/api/users", auth.ScopeAccount},
+		{"POST", "/api/users/verify-email/resend", auth.ScopeAccount},
+		{"POST", "/api/users/2fa/setup", auth.ScopeAccount},
+		{"POST", "/api/users/2fa/confirm", auth.ScopeAccount},
+		{"POST", "/api/users/2fa/disable", auth.ScopeAccount},
+		{"GET", "/api/sessions", auth.ScopeAccount},
+		{"DELETE", "/api/sessions/1", auth.ScopeAccount},
+		{"POST", "/api/logout-all", auth.ScopeAccount},
+		{"POST", "/api/keys", auth.ScopeAccount},
+		{"GET", "/api/keys", auth.ScopeAccount},
+		{"DELETE", "/api/keys/1", auth.ScopeAccount},
+	} {
+		resp := struct {
+			Error string `json:"error"`
+		}{}
+		code := doRequest(t, srv, route.method, route.path, tokens[route.scope], map[string]string{}, &resp)
+		if code != http.StatusForbidden || resp.Error != "missing scope: "+route.scope {
+			t.Errorf("%s %s without %s: got %d %q, want %d", route.method, route.path, route.scope, code, resp.Error, http.StatusForbidden)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/mail"
+)
+
+// fieldError is one problem with one field of a request.
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// respondWithValidationErrors lists every problem with the request's fields.
+// error still holds the first message, as in respondWithError.
+func respondWithValidationErrors(w http.ResponseWriter, errs []fieldError) {
+	respondWithJSON(w, http.StatusBadRequest, struct {
+		Error  string       `json:"error"`
+		Errors []fieldError `json:"errors"`
+	}{
+		Error:  errs[0].Message,
+		Errors: errs,
+	})
+}
+
+// validateCredentials checks a new email address and password. An error
+// means the password couldn't be checked at all.
+func (cfg *apiConfig) validateCredentials(email string, password string) ([]fieldError, error) {
+	errs := []fieldError{}
+	err := validateEmail(email)
+	if err != nil {
+		errs = append(errs, fieldError{Field: "email", Code: "invalid", Message: err.Error()})
+	}
+
+	passwordErrs, err := cfg.validatePassword(password, email)
+	if err != nil {
+		return nil, err
+	}
+	return append(errs, passwordErrs...), nil
+}
+
+func (cfg *apiConfig) validatePassword(password string, userInputs ...string) ([]fieldError, error) {
+	violations, err := cfg.passwordPolicy.Check(password, userInputs...)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := []fieldError{}
+	for _, v := range violations {
+		errs = append(errs, fieldError{Field: "password", Code: v.Code, Message: v.Message})
+	}
+	return errs, nil
+}
+
+// validateEmail accepts a bare address such as "jo@example.com", without a
+// display name or angle brackets.
+func validateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return errors.New("Invalid email address")
+	}
+	return nil
+}